@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const BadArchiveMsg = "Archives must be valid tar, gzipped tar, or zip files, containing only regular files and directories with relative paths"
+
+const ZipTooLargeMsg = "Zip archive is too large to expand, upload its files separately, or as a tar archive"
+
+const (
+	ArchiveTar = "tar"
+	ArchiveZip = "zip"
+)
+
+// archiveContentTypes maps the content types of archive parts to their kind
+var archiveContentTypes = map[string]string{
+	"application/x-tar":            ArchiveTar,
+	"application/x-gtar":           ArchiveTar,
+	"application/x-compressed-tar": ArchiveTar,
+	"application/zip":              ArchiveZip,
+	"application/x-zip-compressed": ArchiveZip,
+}
+
+// archiveExtensions maps the extensions of archive parts to their kind
+var archiveExtensions = map[string]string{
+	".tar":    ArchiveTar,
+	".tar.gz": ArchiveTar,
+	".tgz":    ArchiveTar,
+	".zip":    ArchiveZip,
+}
+
+// ArchiveKind returns the kind of archive a submitted part is, from its content type or extension, or an empty string if it is not one
+func ArchiveKind(filename, contentType string) string {
+	if kind, ok := archiveContentTypes[strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))]; ok {
+		return kind
+	}
+	for extension, kind := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(filename), extension) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// errBadArchive is returned when an archive cannot be expanded because of its contents
+type errBadArchive struct {
+	err error
+}
+
+func (e errBadArchive) Error() string {
+	return e.err.Error()
+}
+
+// errZipTooLarge is returned when a zip archive is larger than the gateway may write to disk to expand it
+type errZipTooLarge struct {
+	maxSize int64
+}
+
+func (e errZipTooLarge) Error() string {
+	return fmt.Sprintf("Zip archive is larger than the limit of %d bytes", e.maxSize)
+}
+
+// ZipSpool is where zip archives are written before they are expanded, as unlike tar archives, they cannot be read as they are uploaded.
+// This is on local disk, whichever storage backend the expanded files are stored in.
+type ZipSpool struct {
+	// Dir is the directory to write archives to, or the system temporary directory if not set
+	Dir string
+	// MaxSize is the largest archive in bytes which may be written, or unlimited if 0
+	MaxSize int64
+}
+
+// archiveEntryName returns the name to store an archive entry under, or an error if it is malicious
+func archiveEntryName(name string) (string, error) {
+	filename, ok := submittedFilename(name)
+	if !ok || strings.Contains(filename, "\\") {
+		return "", errBadArchive{fmt.Errorf("Illegal entry name %q", name)}
+	}
+	return filename, nil
+}
+
+// ExpandArchive stores each regular file in an archive. Directories are skipped, and any other kind of entry, such as a link, is an error.
+func ExpandArchive(kind string, archive io.Reader, spool ZipSpool, store func(filename string, contents io.Reader) error) error {
+	switch kind {
+	case ArchiveTar:
+		return expandTar(archive, store)
+	case ArchiveZip:
+		return expandZip(archive, spool, store)
+	default:
+		return fmt.Errorf("Unknown archive kind %s", kind)
+	}
+}
+
+func expandTar(archive io.Reader, store func(filename string, contents io.Reader) error) error {
+	buffered := bufio.NewReader(archive)
+	// Compressed and uncompressed tars share extensions and content types, so check for the gzip magic number instead
+	var contents io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			return errBadArchive{err}
+		}
+		defer gzipped.Close()
+		contents = gzipped
+	}
+	entries := tar.NewReader(contents)
+	for {
+		header, err := entries.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errBadArchive{err}
+		}
+		// Directories are never created, so their names do not matter, and may be e.g. ./
+		mode := header.FileInfo().Mode()
+		if mode.IsDir() {
+			continue
+		}
+		filename, err := archiveEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if !mode.IsRegular() {
+			return errBadArchive{fmt.Errorf("Entry %s is not a regular file", header.Name)}
+		}
+		err = store(filename, badArchiveReader{entries})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// badArchiveReader marks errors reading an archive entry as the archive's fault
+type badArchiveReader struct {
+	io.Reader
+}
+
+func (r badArchiveReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = errBadArchive{err}
+	}
+	return n, err
+}
+
+func expandZip(archive io.Reader, spool ZipSpool, store func(filename string, contents io.Reader) error) error {
+	// Zip files are indexed from the end, so they must be spooled to disk first
+	spooled, err := os.CreateTemp(spool.Dir, "druid-index-gateway-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spooled.Name())
+	defer spooled.Close()
+	if spool.MaxSize != 0 {
+		archive = io.LimitReader(archive, spool.MaxSize+1)
+	}
+	size, err := io.Copy(spooled, archive)
+	if err != nil {
+		return err
+	}
+	if spool.MaxSize != 0 && size > spool.MaxSize {
+		return errZipTooLarge{spool.MaxSize}
+	}
+	entries, err := zip.NewReader(spooled, size)
+	if err != nil {
+		return errBadArchive{err}
+	}
+	for _, entry := range entries.File {
+		mode := entry.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		filename, err := archiveEntryName(entry.Name)
+		if err != nil {
+			return err
+		}
+		if !mode.IsRegular() {
+			return errBadArchive{fmt.Errorf("Entry %s is not a regular file", entry.Name)}
+		}
+		contents, err := entry.Open()
+		if err != nil {
+			return errBadArchive{err}
+		}
+		err = store(filename, badArchiveReader{contents})
+		contents.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMaliciousPath(t *testing.T) {
+	for p, malicious := range map[string]bool{
+		"data.json":           false,
+		"dir/data.json":       false,
+		"dir/../data.json":    false,
+		"..data.json":         false,
+		".":                   true,
+		"..":                  true,
+		"../data.json":        true,
+		"dir/..":              true,
+		"dir/../../data.json": true,
+		"/etc/passwd":         true,
+	} {
+		if MaliciousPath(p) != malicious {
+			t.Fatalf("Expected MaliciousPath(%q) to be %v", p, malicious)
+		}
+	}
+}
+
+type testArchiveEntry struct {
+	name     string
+	contents string
+	link     bool
+}
+
+func testTarGZ(t *testing.T, entries ...testArchiveEntry) string {
+	buf := &bytes.Buffer{}
+	gzipped := gzip.NewWriter(buf)
+	archive := tar.NewWriter(gzipped)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.contents)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(entry.name, "/") {
+			header.Typeflag = tar.TypeDir
+		}
+		if entry.link {
+			header = &tar.Header{Name: entry.name, Typeflag: tar.TypeSymlink, Linkname: entry.contents}
+		}
+		err := archive.WriteHeader(header)
+		if err == nil && header.Typeflag == tar.TypeReg {
+			_, err = archive.Write([]byte(entry.contents))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipped.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func testZip(t *testing.T, entries ...testArchiveEntry) string {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for _, entry := range entries {
+		w, err := archive.Create(entry.name)
+		if err == nil {
+			_, err = w.Write([]byte(entry.contents))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestArchiveExpansion(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	resp := submitTestTask(t, submitter, map[string]string{
+		"logs.tar.gz": testTarGZ(t,
+			testArchiveEntry{name: "./"},
+			testArchiveEntry{name: "./a.json", contents: `{"a": 1}`},
+			testArchiveEntry{name: "dir/"},
+			testArchiveEntry{name: "dir/b.json", contents: `{"b": 2}`},
+		),
+		"more.zip":   testZip(t, testArchiveEntry{name: "c.json", contents: `{"c": 3}`}),
+		"plain.json": `{"d": 4}`,
+	})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	uris := []string{}
+	for _, uri := range submittedInputSource(t, overlord)["uris"].([]interface{}) {
+		uris = append(uris, uri.(string))
+	}
+	sort.Strings(uris)
+	record := submitter.Metadata.List()[0]
+	expected := []string{"a.json", "c.json", "dir/b.json", "plain.json"}
+	for i, name := range expected {
+		if uris[i] != "http://gateway/files/file/"+record.Group+"/"+name {
+			t.Fatalf("Expected URIs for %v, got %v", expected, uris)
+		}
+	}
+	contents, err := submitter.Files.Get(record.Group, "dir/b.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	if b, _ := io.ReadAll(contents); string(b) != `{"b": 2}` {
+		t.Fatalf("Unexpected contents of expanded file: %q", string(b))
+	}
+	if len(record.Files) != 4 {
+		t.Fatalf("Expected each expanded file to be recorded, got %v", record.Files)
+	}
+
+	for name, archive := range map[string]string{
+		"escape.tar.gz": testTarGZ(t, testArchiveEntry{name: "dir/../../escape.json", contents: `{}`}),
+		"escape.zip":    testZip(t, testArchiveEntry{name: "../escape.json", contents: `{}`}),
+		"link.tgz":      testTarGZ(t, testArchiveEntry{name: "passwd", contents: "/etc/passwd", link: true}),
+		"truncated.zip": "PK not really a zip",
+		"truncated.tgz": testTarGZ(t, testArchiveEntry{name: "a.json", contents: `{"a": 1}`})[:20],
+	} {
+		resp := submitTestTask(t, submitter, map[string]string{name: archive})
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected to be rejected, got %d %s", name, resp.Code, resp.Body.String())
+		}
+	}
+	resp = submitTestTask(t, submitter, map[string]string{
+		"logs.tar.gz": testTarGZ(t, testArchiveEntry{name: "a.json", contents: `{"a": 1}`}),
+		"a.json":      `{"a": 2}`,
+	})
+	if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "a.json was submitted more than once") {
+		t.Fatalf("Expected archive entry with the name of another file to be rejected, got %d %s", resp.Code, resp.Body.String())
+	}
+	// Zip archives are written to local disk, so are limited in size
+	submitter.ZipSpool = ZipSpool{Dir: t.TempDir(), MaxSize: 64}
+	resp = submitTestTask(t, submitter, map[string]string{"large.zip": testZip(t, testArchiveEntry{name: "c.json", contents: strings.Repeat(" ", 128)})})
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected large zip to be rejected, got %d %s", resp.Code, resp.Body.String())
+	}
+	if spooled, _ := os.ReadDir(submitter.ZipSpool.Dir); len(spooled) != 0 {
+		t.Fatalf("Expected spooled zip to be removed, got %v", spooled)
+	}
+	if records := submitter.Metadata.List(); len(records) != 1 {
+		t.Fatalf("Expected rejected archives to be discarded, got %v", records)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const NotOwnerMsg = "Group or task belongs to another principal"
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// Authenticator authenticates requests with one kind of credentials
+type Authenticator interface {
+	// Authenticate returns the principal a request was made by.
+	// ok is false if the request does not have the kind of credentials this authenticator checks,
+	// and err is set if it does, but they are invalid.
+	Authenticate(r *http.Request) (principal Principal, ok bool, err error)
+	// Challenge is the WWW-Authenticate header sent to unauthenticated clients, if any
+	Challenge() string
+}
+
+// Auth authenticates requests to the Submitter, and decides which groups each principal can access
+type Auth struct {
+	// Authenticators are tried in order, and the first one whose kind of credentials a request has is used
+	Authenticators []Authenticator
+	// AdminRole is the role which can access every group
+	AdminRole string
+	// Admins are principals which can access every group, regardless of their roles
+	Admins []string
+}
+
+func (a *Auth) Authenticate(r *http.Request) (Principal, error) {
+	for _, authenticator := range a.Authenticators {
+		principal, ok, err := authenticator.Authenticate(r)
+		if err != nil {
+			return Principal{}, err
+		}
+		if ok {
+			return principal, nil
+		}
+	}
+	return Principal{}, fmt.Errorf("No credentials")
+}
+
+func (a *Auth) IsAdmin(principal Principal) bool {
+	if a == nil {
+		return true
+	}
+	for _, role := range principal.Roles {
+		if role == a.AdminRole {
+			return true
+		}
+	}
+	for _, admin := range a.Admins {
+		if admin == principal.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess returns true if a principal may inspect, follow, or delete a group
+func (a *Auth) CanAccess(principal Principal, record *GroupRecord) bool {
+	return a.IsAdmin(principal) || record.Owner == principal.Name
+}
+
+type principalKey struct{}
+
+// principalOf returns the principal a request handled by Submitter.authenticated was made by
+func principalOf(r *http.Request) Principal {
+	principal, _ := r.Context().Value(principalKey{}).(Principal)
+	return principal
+}
+
+// authenticated wraps a handler so that it is only called for authenticated requests.
+// Every request is allowed as an anonymous principal if authentication is not configured.
+func (s *Submitter) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Auth == nil {
+			handler(w, r)
+			return
+		}
+		principal, err := s.Auth.Authenticate(r)
+		if err != nil {
+			fmt.Printf("Rejected request from %s: %s\n", r.RemoteAddr, err)
+			for _, authenticator := range s.Auth.Authenticators {
+				if challenge := authenticator.Challenge(); len(challenge) != 0 {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			ErrorResponse(w, http.StatusUnauthorized, BadCredentialsMsg)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}
+}
+
+// readCredentialsFile calls parse with the fields of each line of a file, ignoring blank lines and lines starting with #
+func readCredentialsFile(path string, parse func(lineNumber int, fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = parse(lineNumber, strings.Fields(line))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// APIKeyAuthenticator authenticates requests with a static key in the X-Api-Key header
+type APIKeyAuthenticator struct {
+	// principals are indexed by the SHA-256 hash of their key, so that looking up a key does not leak its contents through timing
+	principals map[[sha256.Size]byte]Principal
+}
+
+// LoadAPIKeys reads a file with one key per line, followed by the principal it authenticates as,
+// and optionally a comma-separated list of roles, e.g.
+//
+//	3f9a... alice admin,ingest
+func LoadAPIKeys(path string) (*APIKeyAuthenticator, error) {
+	a := &APIKeyAuthenticator{principals: map[[sha256.Size]byte]Principal{}}
+	err := readCredentialsFile(path, func(lineNumber int, fields []string) error {
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("Expected a key, principal, and optional roles")
+		}
+		principal := Principal{Name: fields[1]}
+		if len(fields) == 3 {
+			principal.Roles = strings.Split(fields[2], ",")
+		}
+		a.principals[sha256.Sum256([]byte(fields[0]))] = principal
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, bool, error) {
+	key := r.Header.Get("X-Api-Key")
+	if len(key) == 0 {
+		return Principal{}, false, nil
+	}
+	principal, ok := a.principals[sha256.Sum256([]byte(key))]
+	if !ok {
+		return Principal{}, true, fmt.Errorf("Unknown API key")
+	}
+	return principal, true, nil
+}
+
+func (a *APIKeyAuthenticator) Challenge() string {
+	return ""
+}
+
+// HtpasswdAuthenticator authenticates requests with HTTP basic credentials from an htpasswd file.
+// Only bcrypt and SHA-1 hashes are supported.
+type HtpasswdAuthenticator struct {
+	hashes map[string]string
+}
+
+func LoadHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	h := &HtpasswdAuthenticator{hashes: map[string]string{}}
+	err := readCredentialsFile(path, func(lineNumber int, fields []string) error {
+		user, hash, ok := strings.Cut(strings.Join(fields, " "), ":")
+		if !ok || len(user) == 0 {
+			return fmt.Errorf("Expected user:hash")
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("Unsupported hash for user %s, use bcrypt (htpasswd -B)", user)
+		}
+		h.hashes[user] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(r *http.Request) (Principal, bool, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return Principal{}, false, nil
+	}
+	hash, ok := h.hashes[user]
+	if !ok {
+		return Principal{}, true, fmt.Errorf("Unknown user %s", user)
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		if subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(strings.TrimPrefix(hash, "{SHA}"))) != 1 {
+			return Principal{}, true, fmt.Errorf("Wrong password for user %s", user)
+		}
+		return Principal{Name: user}, true, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		return Principal{}, true, fmt.Errorf("Wrong password for user %s", user)
+	}
+	return Principal{Name: user}, true, nil
+}
+
+func (h *HtpasswdAuthenticator) Challenge() string {
+	return `Basic realm="druid-index-gateway"`
+}
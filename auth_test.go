@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT signs a token with ES256
+func testJWT(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	filePath := path.Join(dir, name)
+	err := os.WriteFile(filePath, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestSubmitterAuth(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	dir := t.TempDir()
+
+	apiKeys, err := LoadAPIKeys(writeTestFile(t, dir, "keys", "# comment\nalice-key alice ingest\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobHash, err := bcrypt.GenerateFromPassword([]byte("bob-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd, err := LoadHtpasswd(writeTestFile(t, dir, "htpasswd", "bob:"+string(bobHash)+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC",
+		"kid": "key-1",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(signingKey.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(signingKey.Y.Bytes()),
+	}}})
+	keys, err := LoadJWKS(writeTestFile(t, dir, "jwks.json", string(jwks)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt := &JWTAuthenticator{Keys: keys, Audience: "gateway", RolesClaim: "roles"}
+	submitter.Auth = &Auth{Authenticators: []Authenticator{apiKeys, htpasswd, jwt}, AdminRole: "admin"}
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+
+	token := func(claims map[string]interface{}) string {
+		return testJWT(t, signingKey, "key-1", claims)
+	}
+	alice := func(r *http.Request) { r.Header.Set("X-Api-Key", "alice-key") }
+	bob := func(r *http.Request) { r.SetBasicAuth("bob", "bob-password") }
+	admin := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token(map[string]interface{}{
+			"sub": "carol", "aud": []string{"gateway"}, "roles": "ingest admin", "exp": time.Now().Add(time.Hour).Unix(),
+		}))
+	}
+	do := func(method, path string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if method == "POST" {
+			body, contentType := buildSubmission(t, testIndexSpec, map[string]string{"data.json": `{"a": 1}`})
+			req = httptest.NewRequest(method, path, body)
+			req.Header.Set("Content-Type", contentType)
+		}
+		if auth != nil {
+			auth(req)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := do("POST", "/tasks/task", nil)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthenticated submission to be rejected, got %d", resp.Code)
+	}
+	challenges := strings.Join(resp.Header().Values("WWW-Authenticate"), ", ")
+	if !strings.Contains(challenges, "Basic") || !strings.Contains(challenges, "Bearer") {
+		t.Fatalf("Expected Basic and Bearer challenges, got %s", challenges)
+	}
+	rejected := map[string]func(*http.Request){
+		"unknown API key": func(r *http.Request) { r.Header.Set("X-Api-Key", "mallory-key") },
+		"wrong password":  func(r *http.Request) { r.SetBasicAuth("bob", "wrong") },
+		"expired token": func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token(map[string]interface{}{
+				"sub": "carol", "aud": "gateway", "exp": time.Now().Add(-time.Minute).Unix(),
+			}))
+		},
+		"wrong audience": func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token(map[string]interface{}{
+				"sub": "carol", "aud": "other", "exp": time.Now().Add(time.Hour).Unix(),
+			}))
+		},
+		"unknown signing key": func(r *http.Request) {
+			otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			r.Header.Set("Authorization", "Bearer "+testJWT(t, otherKey, "key-1", map[string]interface{}{
+				"sub": "carol", "aud": "gateway", "exp": time.Now().Add(time.Hour).Unix(),
+			}))
+		},
+	}
+	for name, auth := range rejected {
+		if resp := do("GET", "/tasks/task", auth); resp.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected to be rejected, got %d", name, resp.Code)
+		}
+	}
+
+	resp = do("POST", "/tasks/task", alice)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	record, _ := submitter.Metadata.FindTask("task-a")
+	if record.Owner != "alice" {
+		t.Fatalf("Expected group to be owned by alice, got %v", record)
+	}
+
+	list := GroupList{}
+	json.Unmarshal(do("GET", "/tasks/task", bob).Body.Bytes(), &list)
+	if list.Total != 0 {
+		t.Fatalf("Expected bob to see no groups, got %v", list)
+	}
+	for _, path := range []string{"/tasks/task/" + record.Group, "/tasks/task/task-a/status"} {
+		if resp := do("GET", path, bob); resp.Code != http.StatusForbidden {
+			t.Fatalf("Expected bob to be forbidden from %s, got %d", path, resp.Code)
+		}
+		if resp := do("GET", path, alice); resp.Code != http.StatusOK {
+			t.Fatalf("Expected alice to be allowed %s, got %d", path, resp.Code)
+		}
+	}
+	if resp := do("DELETE", "/tasks/task/"+record.Group, bob); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob to be forbidden from deleting alice's group, got %d", resp.Code)
+	}
+
+	list = GroupList{}
+	json.Unmarshal(do("GET", "/tasks/task", admin).Body.Bytes(), &list)
+	if list.Total != 1 || list.Groups[0].Owner != "alice" {
+		t.Fatalf("Expected admin to see alice's group, got %v", list)
+	}
+	if resp := do("DELETE", "/tasks/task/"+record.Group, admin); resp.Code != http.StatusOK {
+		t.Fatalf("Expected admin to delete alice's group, got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt := &JWTAuthenticator{Keys: map[string]crypto.PublicKey{"key-1": &signingKey.PublicKey}, Issuer: "issuer"}
+	claims := map[string]interface{}{"sub": "carol", "iss": "issuer", "exp": time.Now().Add(time.Hour).Unix()}
+	principal, err := jwt.Verify(testJWT(t, signingKey, "key-1", claims), time.Now())
+	if err != nil || principal.Name != "carol" {
+		t.Fatalf("Expected valid token, got %v %v", principal, err)
+	}
+
+	// Tokens must not be able to choose to be unsigned
+	token := testJWT(t, signingKey, "key-1", claims)
+	parts := strings.Split(token, ".")
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "key-1"})
+	_, err = jwt.Verify(base64.RawURLEncoding.EncodeToString(header)+"."+parts[1]+".", time.Now())
+	if err == nil {
+		t.Fatalf("Expected unsigned token to be rejected")
+	}
+
+	claims["iss"] = "other"
+	_, err = jwt.Verify(testJWT(t, signingKey, "key-1", claims), time.Now())
+	if err == nil {
+		t.Fatalf("Expected wrong issuer to be rejected")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"os"
+)
+
+// LoadConfigFile sets flags from a JSON object mapping flag names to values, e.g.
+//
+//	{"druid-username": "gateway", "files-url-key": ["new-key", "old-key"]}
+//
+// Flags given on the command line take precedence over the config file.
+// Arrays set flags which may be repeated once for each element.
+func LoadConfigFile(flags *flag.FlagSet, configPath string) error {
+	configBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	config := map[string]interface{}{}
+	// Keep numbers as they were written, so that large integers are not formatted in scientific notation
+	decoder := json.NewDecoder(bytes.NewReader(configBytes))
+	decoder.UseNumber()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return fmt.Errorf("%s: %s", configPath, err)
+	}
+	for name, value := range config {
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: Unknown flag %s", configPath, name)
+		}
+		if f.Changed {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			err = flags.Set(name, fmt.Sprint(v))
+			if err != nil {
+				return fmt.Errorf("%s: %s: %s", configPath, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const BadCredentialsMsg = "Missing or invalid credentials"
+
+// RedactedPassword replaces fetch passwords in the task specs the gateway logs or returns
+const RedactedPassword = "REDACTED"
+
+// redactedInputSource returns a copy of an inputSource without its fetch password.
+// Password providers are left as they are, as they only say where Druid finds the password.
+func redactedInputSource(inputSource map[string]interface{}) map[string]interface{} {
+	if _, ok := inputSource["httpAuthenticationPassword"].(string); !ok {
+		return inputSource
+	}
+	redacted := make(map[string]interface{}, len(inputSource))
+	for k, v := range inputSource {
+		redacted[k] = v
+	}
+	redacted["httpAuthenticationPassword"] = RedactedPassword
+	return redacted
+}
+
+// redactedTaskSpec encodes a native task spec without the fetch password in its inputSource
+func redactedTaskSpec(taskSpec, ioConfig map[string]interface{}) ([]byte, error) {
+	inputSource, _ := ioConfig["inputSource"].(map[string]interface{})
+	if inputSource == nil {
+		return json.Marshal(taskSpec)
+	}
+	ioConfig["inputSource"] = redactedInputSource(inputSource)
+	defer func() {
+		ioConfig["inputSource"] = inputSource
+	}()
+	return json.Marshal(taskSpec)
+}
+
+// FetchCredentials decides the HTTP basic credentials Druid fetches files with, and checks them in the Retriever
+type FetchCredentials interface {
+	// Credentials returns the httpAuthenticationUsername and httpAuthenticationPassword for a group's input source.
+	// The password is either a string, or a Druid password provider.
+	Credentials(group string) (string, interface{}, error)
+	// Check returns true if a request for a file in a group may be served with the given credentials
+	Check(group, username, password string) bool
+}
+
+// GroupCredentials generates a random password for each task, which can only be used to fetch files in its group.
+// Tasks linked to a group get their own password, so that the tasks already fetching its files keep theirs.
+// Only hashes of the passwords are kept.
+type GroupCredentials struct {
+	Metadata *MetadataStore
+}
+
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+func (g *GroupCredentials) Credentials(group string) (string, interface{}, error) {
+	// The password is random, so it does not need a slow hash
+	passwordBytes := make([]byte, 32)
+	_, err := rand.Read(passwordBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	password := hex.EncodeToString(passwordBytes)
+	err = g.Metadata.Update(group, func(record *GroupRecord) {
+		if len(record.FetchPasswordHash) == 0 {
+			record.FetchPasswordHash = hashPassword(password)
+		} else {
+			record.LinkedFetchPasswordHashes = append(record.LinkedFetchPasswordHashes, hashPassword(password))
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return group, password, nil
+}
+
+func (g *GroupCredentials) Check(group, username, password string) bool {
+	record, ok := g.Metadata.Get(group)
+	if !ok || len(record.FetchPasswordHash) == 0 || username != group {
+		return false
+	}
+	hash := []byte(hashPassword(password))
+	accepted := subtle.ConstantTimeCompare(hash, []byte(record.FetchPasswordHash)) == 1
+	for _, linked := range record.LinkedFetchPasswordHashes {
+		if subtle.ConstantTimeCompare(hash, []byte(linked)) == 1 {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// StaticCredentials uses the same credentials for every group
+type StaticCredentials struct {
+	Username string
+	Password string
+	// PasswordEnv, if set, is the name of an environment variable the Druid tasks read the password from,
+	// so that the password is not part of the task spec
+	PasswordEnv string
+}
+
+func (s *StaticCredentials) Credentials(group string) (string, interface{}, error) {
+	if len(s.PasswordEnv) != 0 {
+		return s.Username, map[string]string{"type": "environment", "variable": s.PasswordEnv}, nil
+	}
+	return s.Username, s.Password, nil
+}
+
+func (s *StaticCredentials) Check(group, username, password string) bool {
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+	return usernameOK && passwordOK
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	TaskStatusRunning = "RUNNING"
+	TaskStatusSuccess = "SUCCESS"
+	TaskStatusFailed  = "FAILED"
+)
+
+// ErrTaskNotFound is returned when the Overlord does not know about a task
+var ErrTaskNotFound = fmt.Errorf("Druid does not know about this task")
+
+// TaskStatusFinished returns true if a task status indicates the task will not run any further
+func TaskStatusFinished(status string) bool {
+	return status == TaskStatusSuccess || status == TaskStatusFailed
+}
+
+type DruidClient struct {
+	IndexerEndpoint url.URL // Should end with druid/indexer/v1/task
+	SQLTaskEndpoint url.URL // Should end with druid/v2/sql/task
+	// Client is used for all requests to Druid, or http.DefaultClient if not set
+	Client *http.Client
+	// Username and Password, if set, are sent as basic credentials with every request
+	Username string
+	Password string
+	// PassthroughAuth sends the Authorization header of the request to the gateway, if any, instead of Username and Password
+	PassthroughAuth bool
+}
+
+// NewDruidHTTPClient builds a client which trusts the system CAs and the CAs in caPath, if set,
+// and presents the certificate in certPath and keyPath, if set
+func NewDruidHTTPClient(caPath, certPath, keyPath string) (*http.Client, error) {
+	if len(caPath) == 0 && len(certPath) == 0 && len(keyPath) == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if len(caPath) != 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		caBytes, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		if !rootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("No certificates found in %s", caPath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if len(certPath) != 0 || len(keyPath) != 0 {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// do sends a request to Druid with the configured credentials.
+// caller is the request to the gateway this request is on behalf of, or nil if it is the gateway's own.
+func (d *DruidClient) do(req *http.Request, caller *http.Request) (*http.Response, error) {
+	if d.PassthroughAuth && caller != nil && len(caller.Header.Get("Authorization")) != 0 {
+		req.Header.Set("Authorization", caller.Header.Get("Authorization"))
+	} else if len(d.Username) != 0 {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (d *DruidClient) post(endpoint url.URL, body []byte, caller *http.Request) (*http.Response, error) {
+	req, err := http.NewRequest("POST", endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return d.do(req, caller)
+}
+
+// TaskURL returns the URL of a sub-resource of a submitted task, e.g. status
+func (d *DruidClient) TaskURL(taskID, resource string) url.URL {
+	taskURL := d.IndexerEndpoint
+	taskURL.Path = strings.TrimSuffix(taskURL.Path, "/") + "/" + taskID + "/" + resource
+	taskURL.RawPath = ""
+	return taskURL
+}
+
+func (d *DruidClient) SubmitTask(taskSpec []byte, caller *http.Request) (*http.Response, error) {
+	return d.post(d.IndexerEndpoint, taskSpec, caller)
+}
+
+func (d *DruidClient) SubmitSQLTask(taskRequest []byte, caller *http.Request) (*http.Response, error) {
+	return d.post(d.SQLTaskEndpoint, taskRequest, caller)
+}
+
+// TaskRequest sends a request for a sub-resource of a submitted task
+func (d *DruidClient) TaskRequest(method, taskID, resource, rawQuery string, caller *http.Request) (*http.Response, error) {
+	taskURL := d.TaskURL(taskID, resource)
+	taskURL.RawQuery = rawQuery
+	req, err := http.NewRequest(method, taskURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.do(req, caller)
+}
+
+type druidTaskStatusResponse struct {
+	Task   string `json:"task"`
+	Status struct {
+		StatusCode string `json:"statusCode"`
+		Status     string `json:"status"`
+	} `json:"status"`
+}
+
+func (d *DruidClient) TaskStatus(taskID string) (string, error) {
+	statusURL := d.TaskURL(taskID, "status")
+	req, err := http.NewRequest("GET", statusURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.do(req, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrTaskNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("Druid returned %s for status of task %s: %s", resp.Status, taskID, string(body))
+	}
+	status := druidTaskStatusResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return "", err
+	}
+	// Older Druid versions only populate one or the other
+	if len(status.Status.StatusCode) != 0 {
+		return status.Status.StatusCode, nil
+	}
+	if len(status.Status.Status) != 0 {
+		return status.Status.Status, nil
+	}
+	return "", fmt.Errorf("Druid returned no status for task %s", taskID)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/pem"
+	flag "github.com/spf13/pflag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDruidCredentials(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	submitter.Druid.Username = "gateway"
+	submitter.Druid.Password = "gateway-password"
+	staticAuth := "Basic Z2F0ZXdheTpnYXRld2F5LXBhc3N3b3Jk"
+
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if overlord.authorizations[0] != staticAuth {
+		t.Fatalf("Expected static credentials, got %v", overlord.authorizations)
+	}
+
+	submitter.Druid.PassthroughAuth = true
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	req := httptest.NewRequest("GET", "/tasks/task/task-a/status", nil)
+	req.Header.Set("Authorization", "Bearer caller-token")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Status request failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if overlord.authorizations[1] != "Bearer caller-token" {
+		t.Fatalf("Expected caller's credentials to be passed through, got %v", overlord.authorizations)
+	}
+
+	// The gateway's own requests have no caller to pass through
+	tracker := &TaskTracker{Files: submitter.Files, Metadata: submitter.Metadata, Druid: submitter.Druid}
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if overlord.authorizations[2] != staticAuth {
+		t.Fatalf("Expected static credentials for status check, got %v", overlord.authorizations)
+	}
+}
+
+func TestDruidCA(t *testing.T) {
+	overlord := &fakeOverlord{statuses: map[string]string{"task-a": TaskStatusRunning}}
+	server := httptest.NewTLSServer(overlord)
+	defer server.Close()
+	indexerURL, err := url.Parse(server.URL + "/druid/indexer/v1/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	druid := &DruidClient{IndexerEndpoint: *indexerURL}
+	_, err = druid.TaskStatus("task-a")
+	if err == nil {
+		t.Fatalf("Expected untrusted certificate to be rejected")
+	}
+
+	caPath := path.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	druid.Client, err = NewDruidHTTPClient(caPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := druid.TaskStatus("task-a")
+	if err != nil || status != TaskStatusRunning {
+		t.Fatalf("Expected status with trusted CA, got %s %v", status, err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	username := flags.String("druid-username", "", "")
+	password := flags.String("druid-password", "", "")
+	partSize := flags.Int("s3-part-size", 0, "")
+	keys := flags.StringArray("files-url-key", []string{}, "")
+	err := flags.Parse([]string{"--druid-username", "from-command-line"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := path.Join(t.TempDir(), "config.json")
+	config := `{"druid-username": "from-config", "druid-password": "secret", "s3-part-size": 16777216, "files-url-key": ["new", "old"]}`
+	err = os.WriteFile(configPath, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadConfigFile(flags, configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *username != "from-command-line" || *password != "secret" || *partSize != 16777216 || len(*keys) != 2 || (*keys)[0] != "new" {
+		t.Fatalf("Unexpected flags %s %s %d %v", *username, *password, *partSize, *keys)
+	}
+
+	err = os.WriteFile(configPath, []byte(`{"no-such-flag": true}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadConfigFile(flags, configPath); err == nil {
+		t.Fatalf("Expected an error for an unknown flag")
+	}
+}
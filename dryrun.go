@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ValidateResource is posted to under the submitter endpoint to validate a submission without submitting it, like dryRun=true
+const ValidateResource = "validate"
+
+// granularities are Druid's named granularities, finest first
+var granularities = []string{"NONE", "SECOND", "MINUTE", "FIVE_MINUTE", "TEN_MINUTE", "FIFTEEN_MINUTE", "THIRTY_MINUTE", "HOUR", "SIX_HOUR", "EIGHT_HOUR", "DAY", "WEEK", "MONTH", "QUARTER", "YEAR", "ALL"}
+
+// smallSegmentRows and largeSegmentRows are the bounds outside of which segments are likely to be too small or too large to query well
+const smallSegmentRows = 100000
+const largeSegmentRows = 20000000
+
+// ValidationResponse is the result of a dry run of a submission
+type ValidationResponse struct {
+	// Valid is true if no errors were found, though Druid may still reject the task
+	Valid bool `json:"valid"`
+	// Spec is the task spec as it would be submitted to Druid, with the gateway's inputSource, inputFormat, and inferred schema,
+	// but with the fetch password redacted
+	Spec     json.RawMessage `json:"spec"`
+	Files    []FileRecord    `json:"files"`
+	Warnings []string        `json:"warnings"`
+	Errors   []string        `json:"errors"`
+}
+
+// isDryRun returns true if a submission asked to only be validated
+func (s *Submitter) isDryRun(r *http.Request) bool {
+	requested := strings.Trim(strings.TrimPrefix(r.URL.Path, s.ContextPath+SubmitterEndpoint), "/")
+	return r.URL.Query().Get("dryRun") == "true" || requested == ValidateResource
+}
+
+// DryRun reads the files of a native task submission, and checks them and its spec as if it was being submitted,
+// without storing the files or submitting the task to Druid. Only the start of each file is kept, to check its format.
+func (s *Submitter) DryRun(w http.ResponseWriter, r *http.Request, taskSpec, ioConfig map[string]interface{}, parts *multipart.Reader) {
+	// The task would point at a new group, but it is never created
+	group := uuid.New().String()
+	items := []string{}
+	files := []FileRecord{}
+	samples := map[string][]byte{}
+	var lock sync.Mutex
+	store := func(filename string, file io.Reader) error {
+		contents := newChecksumReader(file)
+		sample, err := io.ReadAll(io.LimitReader(contents, sniffSize))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, contents)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if len(items) < maxSniffedFiles {
+			samples[filename] = sample
+		}
+		items = append(items, filename)
+		files = append(files, contents.Record(filename))
+		return nil
+	}
+	if !s.receiveParts(w, r, parts, store) {
+		return
+	}
+
+	validation := ValidationResponse{Files: files, Warnings: []string{}, Errors: []string{}}
+	if len(items) == 0 {
+		validation.Errors = append(validation.Errors, "No files were submitted")
+	}
+	err := checkFiles(r, taskSpec, ioConfig, group, items, func(item string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(samples[item])), nil
+	})
+	if _, ok := err.(errBadFiles); ok {
+		validation.Errors = append(validation.Errors, err.Error())
+	} else if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	if _, ok := ioConfig["inputSource"]; ok {
+		validation.Warnings = append(validation.Warnings, "spec.ioConfig.inputSource is replaced with the submitted files")
+	}
+	ioConfig["inputSource"], err = s.previewInputSource(group, items)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	warnings, errs := ValidateTaskSpec(taskSpec)
+	validation.Warnings = append(validation.Warnings, warnings...)
+	validation.Errors = append(validation.Errors, errs...)
+	validation.Valid = len(validation.Errors) == 0
+
+	validation.Spec, err = redactedTaskSpec(taskSpec, ioConfig)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(validation)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// previewInputSource returns the inputSource a task for a group would be submitted with, but without creating credentials
+// for the group, as it does not exist. The password is redacted either way, so a placeholder is used instead.
+func (s *Submitter) previewInputSource(group string, items []string) (map[string]interface{}, error) {
+	if httpInputSource, ok := s.InputSource.(*HTTPInputSource); ok {
+		if _, ok := httpInputSource.Credentials.(*GroupCredentials); ok {
+			preview := *httpInputSource
+			preview.Credentials = &StaticCredentials{Username: group, Password: RedactedPassword}
+			return preview.InputSource(group, items)
+		}
+	}
+	return s.InputSource.InputSource(group, items)
+}
+
+// granularityRank returns how coarse a granularity from a spec is, or -1 if it is not a named granularity, and false if it is invalid.
+// Only strings which are not named granularities are invalid, as granularities can also be objects.
+func granularityRank(granularity interface{}) (int, bool) {
+	name, ok := granularity.(string)
+	if !ok {
+		_, ok = granularity.(map[string]interface{})
+		return -1, ok
+	}
+	for i, candidate := range granularities {
+		if strings.EqualFold(name, candidate) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// ValidateTaskSpec checks a native task spec for mistakes which Druid would reject the task for, or fail it for, once it has started,
+// and returns them as errors, along with warnings for likely mistakes which Druid allows
+func ValidateTaskSpec(taskSpec map[string]interface{}) (warnings, errs []string) {
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	taskType, _ := taskSpec["type"].(string)
+	spec, _ := taskSpec["spec"].(map[string]interface{})
+
+	dataSchema, ok := spec["dataSchema"].(map[string]interface{})
+	if !ok {
+		fail("spec.dataSchema is required")
+	}
+	if dataSource, _ := dataSchema["dataSource"].(string); len(strings.TrimSpace(dataSource)) == 0 {
+		fail("spec.dataSchema.dataSource is required")
+	}
+	if _, ok := dataSchema["parser"]; ok {
+		warn("spec.dataSchema.parser is deprecated, use spec.ioConfig.inputFormat, spec.dataSchema.timestampSpec, and spec.dataSchema.dimensionsSpec instead")
+	} else {
+		timestampSpec, ok := dataSchema["timestampSpec"].(map[string]interface{})
+		if !ok {
+			fail("spec.dataSchema.timestampSpec is required")
+		} else if _, ok := timestampSpec["column"]; !ok {
+			warn("spec.dataSchema.timestampSpec.column is not set, so the timestamp is read from the timestamp column")
+		}
+		if _, ok := dataSchema["dimensionsSpec"]; !ok {
+			warn("spec.dataSchema.dimensionsSpec is not set, so every other column is ingested as a string dimension")
+		}
+	}
+
+	granularitySpec, _ := dataSchema["granularitySpec"].(map[string]interface{})
+	granularity := func(key string, defaultRank int) int {
+		value, ok := granularitySpec[key]
+		if !ok {
+			return defaultRank
+		}
+		rank, valid := granularityRank(value)
+		if !valid {
+			fail("spec.dataSchema.granularitySpec.%s must be one of %s", key, strings.Join(granularities, ", "))
+		}
+		return rank
+	}
+	// Druid defaults to DAY segments, and no query granularity
+	dayRank, _ := granularityRank("DAY")
+	segmentRank := granularity("segmentGranularity", dayRank)
+	queryRank := granularity("queryGranularity", 0)
+	if segmentRank == 0 {
+		fail("spec.dataSchema.granularitySpec.segmentGranularity cannot be NONE")
+	}
+	if segmentRank != -1 && queryRank > segmentRank {
+		fail("spec.dataSchema.granularitySpec.queryGranularity cannot be coarser than segmentGranularity")
+	}
+	if intervals, ok := granularitySpec["intervals"]; ok && intervals != nil {
+		list, ok := intervals.([]interface{})
+		for _, interval := range list {
+			if str, isString := interval.(string); !isString || !strings.Contains(str, "/") {
+				ok = false
+			}
+		}
+		if !ok {
+			fail("spec.dataSchema.granularitySpec.intervals must be a list of ISO8601 intervals, like 2023-01-01/2023-02-01")
+		}
+	}
+	metrics, _ := dataSchema["metricsSpec"].([]interface{})
+	if rollup, ok := granularitySpec["rollup"]; (!ok || rollup == true) && len(metrics) == 0 {
+		warn("spec.dataSchema.granularitySpec.rollup is not false, but there is no metricsSpec, so identical rows are combined without counting them")
+	}
+
+	ioConfig, _ := spec["ioConfig"].(map[string]interface{})
+	if ioConfig["type"] != taskType {
+		fail("spec.ioConfig.type must be %s", taskType)
+	}
+	tuningConfig, hasTuningConfig := spec["tuningConfig"].(map[string]interface{})
+	if hasTuningConfig && tuningConfig["type"] != taskType {
+		fail("spec.tuningConfig.type must be %s", taskType)
+	}
+	forceGuaranteedRollup, _ := tuningConfig["forceGuaranteedRollup"].(bool)
+	partitionsSpec, _ := tuningConfig["partitionsSpec"].(map[string]interface{})
+	partitionsType := "dynamic"
+	if partitionsSpec != nil {
+		partitionsType, _ = partitionsSpec["type"].(string)
+	}
+	switch partitionsType {
+	case "dynamic":
+		if forceGuaranteedRollup {
+			fail("spec.tuningConfig.forceGuaranteedRollup requires a hashed, single_dim, or range partitionsSpec")
+		}
+	case "hashed", "single_dim", "range":
+		if !forceGuaranteedRollup {
+			fail("A %s partitionsSpec requires spec.tuningConfig.forceGuaranteedRollup to be true", partitionsType)
+		}
+		if ioConfig["appendToExisting"] == true {
+			fail("spec.ioConfig.appendToExisting cannot be used with a %s partitionsSpec", partitionsType)
+		}
+		_, hasTarget := partitionsSpec["targetRowsPerSegment"]
+		_, hasMax := partitionsSpec["maxRowsPerSegment"]
+		_, hasShards := partitionsSpec["numShards"]
+		if hasTarget && hasMax {
+			fail("spec.tuningConfig.partitionsSpec can only set one of targetRowsPerSegment and maxRowsPerSegment")
+		}
+		if hasShards && (hasTarget || hasMax) {
+			fail("spec.tuningConfig.partitionsSpec cannot set numShards with targetRowsPerSegment or maxRowsPerSegment")
+		}
+		if partitionsType != "hashed" && taskType != "index_parallel" {
+			fail("A %s partitionsSpec requires an index_parallel task", partitionsType)
+		}
+		if subTasks, _ := tuningConfig["maxNumConcurrentSubTasks"].(float64); partitionsType != "hashed" && subTasks <= 1 {
+			warn("A %s partitionsSpec needs spec.tuningConfig.maxNumConcurrentSubTasks to be more than 1", partitionsType)
+		}
+	default:
+		fail("spec.tuningConfig.partitionsSpec.type must be dynamic, hashed, single_dim, or range")
+	}
+	if dimension, _ := partitionsSpec["partitionDimension"].(string); partitionsType == "single_dim" && len(dimension) == 0 {
+		fail("A single_dim partitionsSpec requires partitionDimension")
+	}
+	if dimensions, _ := partitionsSpec["partitionDimensions"].([]interface{}); partitionsType == "range" && len(dimensions) == 0 {
+		fail("A range partitionsSpec requires partitionDimensions")
+	}
+	for _, key := range []string{"maxRowsPerSegment", "targetRowsPerSegment", "numShards", "maxTotalRows"} {
+		value, ok := partitionsSpec[key]
+		if !ok || value == nil {
+			continue
+		}
+		n, isNumber := value.(float64)
+		if !isNumber || n <= 0 {
+			fail("spec.tuningConfig.partitionsSpec.%s must be a positive number", key)
+			continue
+		}
+		if (key == "maxRowsPerSegment" || key == "targetRowsPerSegment") && n < smallSegmentRows {
+			warn("spec.tuningConfig.partitionsSpec.%s is less than %d, which makes many small segments", key, smallSegmentRows)
+		}
+		if (key == "maxRowsPerSegment" || key == "targetRowsPerSegment") && n > largeSegmentRows {
+			warn("spec.tuningConfig.partitionsSpec.%s is more than %d, which makes segments slow to query", key, largeSegmentRows)
+		}
+	}
+	return warnings, errs
+}
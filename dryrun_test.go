@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	validate := func(path, spec string, files map[string]string) ValidationResponse {
+		mux := http.NewServeMux()
+		submitter.Handle(mux)
+		body, contentType := buildSubmission(t, spec, files)
+		req := httptest.NewRequest("POST", path, body)
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Dry run failed: %d %s", resp.Code, resp.Body.String())
+		}
+		validation := ValidationResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&validation); err != nil {
+			t.Fatal(err)
+		}
+		return validation
+	}
+
+	spec := `{"type": "index_parallel", "spec": {
+		"dataSchema": {"dataSource": "test", "timestampSpec": {"column": "time"}, "dimensionsSpec": {}, "granularitySpec": {"rollup": false}},
+		"ioConfig": {"type": "index_parallel"},
+		"tuningConfig": {"type": "index_parallel", "partitionsSpec": {"type": "dynamic", "maxRowsPerSegment": 5000000}}
+	}}`
+	validation := validate("/tasks/task?dryRun=true", spec, map[string]string{"a.csv": "time,page\n1,a\n"})
+	if !validation.Valid || len(validation.Errors) != 0 || len(validation.Warnings) != 0 {
+		t.Fatalf("Expected spec to be valid, got %#v", validation)
+	}
+	if len(validation.Files) != 1 || validation.Files[0].Name != "a.csv" || validation.Files[0].Size != 14 {
+		t.Fatalf("Unexpected files %v", validation.Files)
+	}
+	for _, expected := range []string{`"inputFormat":{"findColumnsFromHeader":true,"type":"csv"}`, `"uris":["http://gateway/files/file/`} {
+		if !strings.Contains(string(validation.Spec), expected) {
+			t.Fatalf("Expected %s in rewritten spec %s", expected, validation.Spec)
+		}
+	}
+	if len(overlord.specs) != 0 || len(submitter.Metadata.List()) != 0 {
+		t.Fatalf("Expected nothing to be submitted or stored, got %d tasks and %d groups", len(overlord.specs), len(submitter.Metadata.List()))
+	}
+
+	bad := `{"type": "index_parallel", "spec": {
+		"dataSchema": {"dataSource": "", "granularitySpec": {"segmentGranularity": "HOUR", "queryGranularity": "DAY", "intervals": ["2023-01-01"]}},
+		"ioConfig": {"type": "index", "inputFormat": {"type": "csv", "findColumnsFromHeader": true}},
+		"tuningConfig": {"type": "index_parallel", "partitionsSpec": {"type": "range", "targetRowsPerSegment": 1000, "maxRowsPerSegment": 1000}}
+	}}`
+	validation = validate("/tasks/task/validate", bad, map[string]string{"a.json": `{"time": 1}`})
+	if validation.Valid {
+		t.Fatalf("Expected spec to be invalid")
+	}
+	errors := strings.Join(validation.Errors, "\n")
+	for _, expected := range []string{
+		"a.json looks like json",
+		"dataSource is required",
+		"timestampSpec is required",
+		"queryGranularity cannot be coarser than segmentGranularity",
+		"intervals must be a list of ISO8601 intervals",
+		"spec.ioConfig.type must be index_parallel",
+		"requires spec.tuningConfig.forceGuaranteedRollup",
+		"only set one of targetRowsPerSegment and maxRowsPerSegment",
+		"range partitionsSpec requires partitionDimensions",
+	} {
+		if !strings.Contains(errors, expected) {
+			t.Fatalf("Expected error %q, got %s", expected, errors)
+		}
+	}
+	warnings := strings.Join(validation.Warnings, "\n")
+	for _, expected := range []string{"many small segments", "maxNumConcurrentSubTasks", "rollup is not false"} {
+		if !strings.Contains(warnings, expected) {
+			t.Fatalf("Expected warning %q, got %s", expected, warnings)
+		}
+	}
+	if len(overlord.specs) != 0 || len(submitter.Metadata.List()) != 0 {
+		t.Fatalf("Expected nothing to be submitted or stored")
+	}
+
+	// Passwords are never returned, and group passwords are never created
+	for _, credentials := range []FetchCredentials{&StaticCredentials{Username: "druid", Password: "static-secret"}, &GroupCredentials{Metadata: submitter.Metadata}} {
+		submitter.InputSource.(*HTTPInputSource).Credentials = credentials
+		validation = validate("/tasks/task/validate", spec, map[string]string{"a.csv": "time,page\n1,a\n"})
+		if strings.Contains(string(validation.Spec), "static-secret") || !strings.Contains(string(validation.Spec), `"httpAuthenticationPassword":"`+RedactedPassword+`"`) {
+			t.Fatalf("Expected password to be redacted, got %s", validation.Spec)
+		}
+		if len(submitter.Metadata.List()) != 0 {
+			t.Fatalf("Expected no groups to be created, got %d", len(submitter.Metadata.List()))
+		}
+	}
+}
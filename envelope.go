@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EnvelopeContentType is requested with the Accept header, or envelope=true, to receive a SubmissionResponse instead of Druid's response as-is.
+// Submissions which infer their schema always receive one, so that the generated spec can be reused.
+const EnvelopeContentType = "application/vnd.druid-index-gateway.submission+json"
+
+// SubmissionResponse describes a submission, along with Druid's response to it
+type SubmissionResponse struct {
+	Group string       `json:"group"`
+	Files []FileRecord `json:"files"`
+	// Spec is the task spec, or for SQL-based ingestion, the query, as it was submitted to Druid, but with the fetch password redacted
+	Spec json.RawMessage `json:"spec"`
+	// TaskID is omitted if Druid did not accept the task, in which case the group is usually discarded
+	TaskID  string    `json:"taskId,omitempty"`
+	Expires time.Time `json:"expires"`
+	// DruidStatus is the status code of Druid's response, which is also the status code of this one
+	DruidStatus int `json:"druidStatus"`
+	// DruidResponse is the body of Druid's response, or a string of it if it was not JSON
+	DruidResponse json.RawMessage `json:"druidResponse,omitempty"`
+}
+
+// wantsEnvelope returns true if a submission asked for a SubmissionResponse
+func wantsEnvelope(r *http.Request) bool {
+	if r.URL.Query().Get("envelope") == "true" || r.URL.Query().Get("inferSchema") == "true" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == EnvelopeContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTaskResponse relays Druid's response to a task submission, or if the submission asked for one, sends a SubmissionResponse
+func (s *Submitter) writeTaskResponse(w http.ResponseWriter, r *http.Request, group string, spec []byte, taskID string, taskResponse *http.Response, taskResponseBody []byte) {
+	if !wantsEnvelope(r) {
+		for name, values := range taskResponse.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(taskResponse.StatusCode)
+		w.Write(taskResponseBody)
+		return
+	}
+	record, _ := s.Metadata.Get(group)
+	submission := SubmissionResponse{
+		Group:       group,
+		Files:       record.Files,
+		Spec:        spec,
+		TaskID:      taskID,
+		Expires:     record.LastActive().Add(s.RetentionPeriod),
+		DruidStatus: taskResponse.StatusCode,
+	}
+	if submission.Files == nil {
+		submission.Files = []FileRecord{}
+	}
+	if json.Valid(taskResponseBody) {
+		submission.DruidResponse = taskResponseBody
+	} else if len(taskResponseBody) != 0 {
+		submission.DruidResponse, _ = json.Marshal(string(taskResponseBody))
+	}
+	w.Header().Set("Content-Type", EnvelopeContentType)
+	w.WriteHeader(taskResponse.StatusCode)
+	json.NewEncoder(w).Encode(submission)
+}
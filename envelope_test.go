@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmissionEnvelope(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	submitter.RetentionPeriod = time.Hour
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+
+	// Without asking for it, Druid's response is relayed as-is
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK || strings.TrimSpace(resp.Body.String()) != `{"task":"task-a"}` {
+		t.Fatalf("Unexpected response without envelope: %d %s", resp.Code, resp.Body.String())
+	}
+
+	body, contentType := buildSubmission(t, testIndexSpec, map[string]string{"data.json": `{"a": 1}`})
+	req := httptest.NewRequest("POST", "/tasks/task", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json, "+EnvelopeContentType+"; q=0.9")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != EnvelopeContentType {
+		t.Fatalf("Submission failed: %d %v %s", resp.Code, resp.Header(), resp.Body.String())
+	}
+	submission := SubmissionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&submission); err != nil {
+		t.Fatal(err)
+	}
+	record, ok := submitter.Metadata.Get(submission.Group)
+	if !ok || submission.TaskID != "task-b" || record.TaskID != "task-b" {
+		t.Fatalf("Unexpected group or task in %+v", submission)
+	}
+	if len(submission.Files) != 1 || submission.Files[0].Name != "data.json" || submission.Files[0].Size != 8 || len(submission.Files[0].SHA256) == 0 {
+		t.Fatalf("Unexpected files %v", submission.Files)
+	}
+	if !submission.Expires.Equal(record.Created.Add(time.Hour)) {
+		t.Fatalf("Unexpected expiry %s", submission.Expires)
+	}
+	if !strings.Contains(string(submission.Spec), `"uris":["http://gateway/files/file/`+submission.Group+`/data.json"]`) {
+		t.Fatalf("Expected submitted spec to be rewritten, got %s", submission.Spec)
+	}
+	if submission.DruidStatus != http.StatusOK || string(submission.DruidResponse) != `{"task":"task-b"}` {
+		t.Fatalf("Unexpected Druid response %d %s", submission.DruidStatus, submission.DruidResponse)
+	}
+
+	body = &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	queryPart, _ := writer.CreateFormField("query")
+	queryPart.Write([]byte("INSERT INTO test SELECT * FROM TABLE(EXTERN(" + InputSourcePlaceholder + ", '{}', '[]')) PARTITIONED BY DAY"))
+	filePart, _ := writer.CreateFormFile("file", "data.json")
+	filePart.Write([]byte(`{"a": 1}`))
+	writer.Close()
+	req = httptest.NewRequest("POST", "/tasks/sql?envelope=true", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	submission = SubmissionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&submission); err != nil || resp.Code != http.StatusOK {
+		t.Fatalf("SQL submission failed: %d %v", resp.Code, err)
+	}
+	query := SQLTaskRequest{}
+	if err := json.Unmarshal(submission.Spec, &query); err != nil || !strings.Contains(query.Query, submission.Group+"/data.json") {
+		t.Fatalf("Expected submitted query to be rewritten, got %s", submission.Spec)
+	}
+	if submission.TaskID != "query-a" || len(submission.Files) != 1 {
+		t.Fatalf("Unexpected SQL submission %+v", submission)
+	}
+}
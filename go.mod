@@ -5,4 +5,5 @@ go 1.18
 require (
 	github.com/google/uuid v1.3.0
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.9.0
 )
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const GroupsEndpoint = "/groups"
+
+const BadGroupsMethodMsg = "/groups endpoint supports POST for creating a group to upload files to, /groups/{group}/files/{file} supports PUT for uploading a whole file, PATCH for uploading part of a file, and HEAD for how much of it has been uploaded, and /groups/{group}/submit and /groups/{group}/sql support POST for submitting a task for the uploaded files"
+
+const BadUploadOffsetMsg = "File uploads must have an Upload-Offset header with the number of bytes of the file already uploaded, and if set, an Upload-Length header with the size of the whole file, which is not less than Upload-Offset"
+
+const UploadOffsetMismatchMsg = "Upload-Offset does not match the number of bytes of the file already uploaded, check the offset with HEAD and resume from there"
+
+const UploadTooLongMsg = "Upload is longer than the Upload-Length of the file"
+
+const UploadInProgressMsg = "This file is already being uploaded by another request"
+
+const GroupSubmittedMsg = "A task has already been submitted for this group, so files can no longer be uploaded to it"
+
+const GroupNotLinkableMsg = "More tasks can only be submitted for a group once its first task has been accepted, and not if its file was streamed"
+
+const NoUploadsMsg = "No files have been uploaded to this group"
+
+const ResumableStorageMsg = "Resumable uploads are not supported by this gateway's storage, upload whole files with PUT instead"
+
+// UploadOffsetHeader is the number of bytes of a file uploaded so far
+const UploadOffsetHeader = "Upload-Offset"
+
+// UploadLengthHeader is the size of a whole file being uploaded in parts
+const UploadLengthHeader = "Upload-Length"
+
+// GroupCreated is the response to creating a group
+type GroupCreated struct {
+	Group   string    `json:"group"`
+	Expires time.Time `json:"expires"`
+}
+
+// Groups handles uploading files to a group over any number of requests, and then submitting a task for them
+func (s *Submitter) Groups(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, s.ContextPath+GroupsEndpoint), "/")
+	if len(rest) == 0 {
+		if r.Method != "POST" {
+			ErrorResponse(w, http.StatusMethodNotAllowed, BadGroupsMethodMsg)
+			return
+		}
+		s.CreateGroup(w, r)
+		return
+	}
+	group, rest, _ := strings.Cut(rest, "/")
+	if MaliciousPath(group) || HiddenGroup(group) {
+		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
+		return
+	}
+	record, ok := s.Metadata.Get(group)
+	if !ok || !record.Deleted.IsZero() {
+		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
+		return
+	}
+	if s.Auth != nil && !s.Auth.CanAccess(principalOf(r), &record) {
+		ErrorResponse(w, http.StatusForbidden, NotOwnerMsg)
+		return
+	}
+	switch {
+	case rest == "submit" && r.Method == "POST":
+		s.SubmitGroup(w, r, group)
+	case rest == "sql" && r.Method == "POST":
+		s.SubmitGroupSQL(w, r, group)
+	case strings.HasPrefix(rest, "files/"):
+		item, ok := submittedFilename(strings.TrimPrefix(rest, "files/"))
+		if !ok {
+			ErrorResponse(w, http.StatusNotFound, BadFileMsg)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			s.PutFile(w, r, group, item)
+		case "PATCH":
+			s.AppendFile(w, r, group, item)
+		case "HEAD":
+			s.UploadOffset(w, r, &record, item)
+		default:
+			ErrorResponse(w, http.StatusMethodNotAllowed, BadGroupsMethodMsg)
+		}
+	default:
+		ErrorResponse(w, http.StatusMethodNotAllowed, BadGroupsMethodMsg)
+	}
+}
+
+// CreateGroup creates an empty group for files to be uploaded to
+func (s *Submitter) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := s.createGroup(r, "")
+	if err == nil {
+		err = s.Metadata.Update(group, func(record *GroupRecord) {
+			record.Pending = true
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	record, _ := s.Metadata.Get(group)
+	fmt.Printf("Created group %s for %s (%s)\n", group, r.RemoteAddr, principalOf(r).Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", s.ContextPath+GroupsEndpoint+"/"+group)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(GroupCreated{Group: group, Expires: record.LastActive().Add(s.RetentionPeriod)})
+}
+
+// updateUpload changes the record of a file uploaded to a group, creating it if needed, and returns false if the group is no longer pending.
+// uploading is added to the number of uploads in progress, which keep the group from expiring.
+func (s *Submitter) updateUpload(group, item string, uploading int, update func(upload *UploadRecord)) (bool, error) {
+	var pending bool
+	err := s.Metadata.Update(group, func(record *GroupRecord) {
+		pending = record.Pending
+		if !pending {
+			return
+		}
+		record.uploading += uploading
+		record.LastUpload = time.Now()
+		for i := range record.Uploads {
+			if record.Uploads[i].Name == item {
+				update(&record.Uploads[i])
+				return
+			}
+		}
+		upload := UploadRecord{FileRecord: FileRecord{Name: item}}
+		update(&upload)
+		record.Uploads = append(record.Uploads, upload)
+	})
+	return pending, err
+}
+
+// endUpload records that an upload to a group started with updateUpload has ended, successfully or not
+func (s *Submitter) endUpload(group string) {
+	err := s.Metadata.Update(group, func(record *GroupRecord) {
+		record.uploading--
+		if record.Pending {
+			record.LastUpload = time.Now()
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// PutFile uploads a whole file to a group, replacing it if it was already uploaded
+func (s *Submitter) PutFile(w http.ResponseWriter, r *http.Request, group, item string) {
+	// Mark the file incomplete until it is received, so that the group cannot be submitted without it
+	pending, err := s.updateUpload(group, item, 1, func(upload *UploadRecord) {
+		upload.Complete = false
+	})
+	if pending {
+		defer s.endUpload(group)
+	}
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	if !pending {
+		ErrorResponse(w, http.StatusConflict, GroupSubmittedMsg)
+		return
+	}
+	contents := newChecksumReader(r.Body)
+	err = s.Files.Put(group, item, contents)
+	if err == nil {
+		_, err = s.updateUpload(group, item, 0, func(upload *UploadRecord) {
+			upload.FileRecord = contents.Record(item)
+			upload.Length = nil
+			upload.Complete = true
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(contents.Record(item))
+}
+
+// AppendFile adds the body of a request to the end of a file in a group, if the Upload-Offset header matches how much of it has been uploaded so far
+func (s *Submitter) AppendFile(w http.ResponseWriter, r *http.Request, group, item string) {
+	appender, ok := s.Files.(Appender)
+	if !ok {
+		ErrorResponse(w, http.StatusNotImplemented, ResumableStorageMsg)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		ErrorResponse(w, http.StatusBadRequest, BadUploadOffsetMsg)
+		return
+	}
+	var length *int64
+	if lengthHeader := r.Header.Get(UploadLengthHeader); len(lengthHeader) != 0 {
+		parsed, err := strconv.ParseInt(lengthHeader, 10, 64)
+		if err != nil || parsed < offset {
+			ErrorResponse(w, http.StatusBadRequest, BadUploadOffsetMsg)
+			return
+		}
+		length = &parsed
+	}
+	// Record the file first, so that it is known, but incomplete, even if the upload is interrupted
+	var wasComplete bool
+	pending, err := s.updateUpload(group, item, 1, func(upload *UploadRecord) {
+		if length != nil {
+			upload.Length = length
+		}
+		length = upload.Length
+		wasComplete = upload.Complete
+		upload.Complete = false
+	})
+	if pending {
+		defer s.endUpload(group)
+	}
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	if !pending {
+		ErrorResponse(w, http.StatusConflict, GroupSubmittedMsg)
+		return
+	}
+	var body io.Reader = r.Body
+	if length != nil {
+		body = io.LimitReader(r.Body, *length-offset)
+	}
+	size, err := appender.Append(group, item, offset, body)
+	switch err {
+	case nil:
+	case ErrOffsetMismatch:
+		// Nothing was written, e.g. the client is retrying a part which was already received
+		_, err = s.updateUpload(group, item, 0, func(upload *UploadRecord) {
+			upload.Complete = wasComplete
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(size, 10))
+		ErrorResponse(w, http.StatusConflict, UploadOffsetMismatchMsg)
+		return
+	case ErrAppendInProgress:
+		ErrorResponse(w, http.StatusConflict, UploadInProgressMsg)
+		return
+	default:
+		// Usually the upload was interrupted, in which case the client is gone, and will check the offset to resume
+		fmt.Printf("Upload of %s/%s interrupted at %d bytes: %s\n", group, item, size, err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	_, err = s.updateUpload(group, item, 0, func(upload *UploadRecord) {
+		upload.Size = size
+		// The checksum is calculated on submission, since the file was not received all at once
+		upload.SHA256 = ""
+		upload.Complete = upload.Length == nil || *upload.Length == size
+	})
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(size, 10))
+	// Anything past the end of the file was not written
+	if length != nil {
+		if n, _ := r.Body.Read(make([]byte, 1)); n != 0 {
+			ErrorResponse(w, http.StatusBadRequest, UploadTooLongMsg)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadOffset reports how much of a file has been uploaded so far, and how large it will be, if known
+func (s *Submitter) UploadOffset(w http.ResponseWriter, r *http.Request, record *GroupRecord, item string) {
+	var size int64
+	info, err := s.Files.Stat(record.Group, item)
+	if err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	for _, upload := range record.Uploads {
+		if upload.Name == item && upload.Length != nil {
+			w.Header().Set(UploadLengthHeader, strconv.FormatInt(*upload.Length, 10))
+		}
+	}
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// SubmitGroup submits a native task spec in the request body for the files uploaded to a group
+func (s *Submitter) SubmitGroup(w http.ResponseWriter, r *http.Request, group string) {
+	fmt.Printf("Task submission for group %s from %s (%s)\n", group, r.RemoteAddr, principalOf(r).Name)
+	taskSpec, spec, ioConfig, ok := s.submittedTaskSpec(w, r, func() (io.Reader, error) {
+		return r.Body, nil
+	})
+	if !ok {
+		return
+	}
+	policyRequest := NativePolicyRequest(taskSpec["type"].(string), spec)
+	s.submitGroup(w, r, group, policyRequest, func(items []string) bool {
+		return s.submitIndexTask(w, r, taskSpec, ioConfig, group, items)
+	})
+}
+
+// SubmitGroupSQL submits an SQL statement in the request body for the files uploaded to a group
+func (s *Submitter) SubmitGroupSQL(w http.ResponseWriter, r *http.Request, group string) {
+	fmt.Printf("SQL task submission for group %s from %s (%s)\n", group, r.RemoteAddr, principalOf(r).Name)
+	taskRequest, ok := parseSQLTaskRequest(w, r.Body, r.Header.Get("Content-Type"))
+	if !ok {
+		return
+	}
+	policyRequest, err := SQLPolicyRequest(taskRequest.Query)
+	if err != nil && s.Policy != nil {
+		ErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+	s.submitGroup(w, r, group, policyRequest, func(items []string) bool {
+		return s.submitSQLTask(w, r, taskRequest, group, items)
+	})
+}
+
+// submitGroup records the files uploaded to a group, and submits a task for them, if every upload is complete.
+// If the task is not accepted, files can still be uploaded to the group, and it can be submitted again.
+// Once a task is accepted, more tasks may be submitted for the same files, which are linked to the group.
+func (s *Submitter) submitGroup(w http.ResponseWriter, r *http.Request, group string, policyRequest PolicyRequest, submit func(items []string) bool) {
+	if !s.checkPolicy(w, r, policyRequest) {
+		return
+	}
+	keep := r.URL.Query().Get("keep") == "true"
+	// Only one submission at a time may claim the group, and no more files may be uploaded once it has
+	var claimed, linked bool
+	var uploads []UploadRecord
+	var files []FileRecord
+	incomplete := []string{}
+	err := s.Metadata.Update(group, func(record *GroupRecord) {
+		if !record.Pending {
+			if len(record.TaskID) == 0 || record.Streamed || !record.Deleted.IsZero() {
+				return
+			}
+			// Keep the group until this task has been submitted, and tracked if it is accepted
+			linked = true
+			record.submitting++
+			record.Keep = record.Keep || keep
+			files = append(files, record.Files...)
+			return
+		}
+		for _, upload := range record.Uploads {
+			if !upload.Complete {
+				incomplete = append(incomplete, upload.Name)
+			}
+		}
+		if len(incomplete) != 0 {
+			return
+		}
+		claimed = true
+		record.Pending = false
+		record.Keep = record.Keep || keep
+		uploads = append(uploads, record.Uploads...)
+	})
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	if linked {
+		s.linkTask(group, files, submit)
+		return
+	}
+	if len(incomplete) != 0 {
+		ErrorResponse(w, http.StatusConflict, fmt.Sprintf("These files have not been completely uploaded: %s", strings.Join(incomplete, ", ")))
+		return
+	}
+	if !claimed {
+		ErrorResponse(w, http.StatusConflict, GroupNotLinkableMsg)
+		return
+	}
+	var successful bool
+	defer func() {
+		if successful {
+			return
+		}
+		err := s.Metadata.Update(group, func(record *GroupRecord) {
+			record.Pending = true
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	if len(uploads) == 0 {
+		ErrorResponse(w, http.StatusBadRequest, NoUploadsMsg)
+		return
+	}
+	files, err = s.checksumUploads(group, uploads)
+	if err == nil {
+		err = s.Metadata.Update(group, func(record *GroupRecord) {
+			record.DataSource = policyRequest.DataSource
+			record.Files = files
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	items := []string{}
+	for _, file := range files {
+		items = append(items, file.Name)
+	}
+	successful = submit(items)
+}
+
+// linkTask submits another task for the files in a group
+func (s *Submitter) linkTask(group string, files []FileRecord, submit func(items []string) bool) {
+	defer func() {
+		err := s.Metadata.Update(group, func(record *GroupRecord) {
+			record.submitting--
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	fmt.Printf("Linking task to group %s\n", group)
+	items := []string{}
+	for _, file := range files {
+		items = append(items, file.Name)
+	}
+	submit(items)
+}
+
+// checksumUploads records the size and checksum of each file uploaded to a group, reading the files whose checksums are not yet known
+func (s *Submitter) checksumUploads(group string, uploads []UploadRecord) ([]FileRecord, error) {
+	files := []FileRecord{}
+	for _, upload := range uploads {
+		if len(upload.SHA256) != 0 {
+			files = append(files, upload.FileRecord)
+			continue
+		}
+		f, err := s.Files.Get(group, upload.Name)
+		if err != nil {
+			return nil, err
+		}
+		contents := newChecksumReader(f)
+		_, err = io.Copy(io.Discard, contents)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, contents.Record(upload.Name))
+	}
+	return files, nil
+}
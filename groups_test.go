@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// interruptedReader returns an error after its contents, like a request body whose connection dropped
+type interruptedReader struct {
+	io.Reader
+}
+
+func (r interruptedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = fmt.Errorf("connection reset")
+	}
+	return n, err
+}
+
+func TestResumableUploads(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	request := func(method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	offset := func(n int) map[string]string {
+		return map[string]string{UploadOffsetHeader: fmt.Sprint(n)}
+	}
+
+	resp := request("POST", "/tasks/groups", nil, nil)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Creating group failed: %d %s", resp.Code, resp.Body.String())
+	}
+	created := GroupCreated{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	filePath := "/tasks/groups/" + created.Group + "/files/dir/data.json"
+	contents := `{"a": 1}` + "\n" + `{"a": 2}` + "\n"
+
+	if resp := request("HEAD", filePath, nil, nil); resp.Code != http.StatusOK || resp.Header().Get(UploadOffsetHeader) != "0" {
+		t.Fatalf("Expected new file to be empty, got %d %v", resp.Code, resp.Header())
+	}
+	if resp := request("PATCH", filePath, strings.NewReader(contents[:5]), offset(0)); resp.Code != http.StatusNoContent || resp.Header().Get(UploadOffsetHeader) != "5" {
+		t.Fatalf("First chunk failed: %d %v %s", resp.Code, resp.Header(), resp.Body.String())
+	}
+	// The connection drops part way through the next chunk
+	request("PATCH", filePath, interruptedReader{strings.NewReader(contents[5:12])}, offset(5))
+	resp = request("HEAD", filePath, nil, nil)
+	if resp.Header().Get(UploadOffsetHeader) != "12" {
+		t.Fatalf("Expected interrupted chunk to be kept, got offset %s", resp.Header().Get(UploadOffsetHeader))
+	}
+	if resp := request("PATCH", filePath, strings.NewReader(contents[5:]), offset(5)); resp.Code != http.StatusConflict || resp.Header().Get(UploadOffsetHeader) != "12" {
+		t.Fatalf("Expected wrong offset to conflict, got %d %v", resp.Code, resp.Header())
+	}
+	if resp := request("PATCH", filePath, strings.NewReader(contents[12:]), offset(12)); resp.Code != http.StatusNoContent {
+		t.Fatalf("Resumed chunk failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request("PATCH", filePath, strings.NewReader(""), nil); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected missing offset to be rejected, got %d", resp.Code)
+	}
+
+	resp = request("POST", "/tasks/groups/"+created.Group+"/submit", strings.NewReader(testIndexSpec), nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submitting group failed: %d %s", resp.Code, resp.Body.String())
+	}
+	uris := submittedInputSource(t, overlord)["uris"].([]interface{})
+	if len(uris) != 1 || uris[0] != "http://gateway/files/file/"+created.Group+"/dir/data.json" {
+		t.Fatalf("Unexpected URIs %v", uris)
+	}
+	record, _ := submitter.Metadata.Get(created.Group)
+	if record.Pending || record.TaskID != "task-a" || record.DataSource != "test" || len(record.Files) != 1 || record.Files[0].Size != int64(len(contents)) {
+		t.Fatalf("Unexpected record of submitted group: %#v", record)
+	}
+	f, err := submitter.Files.Get(created.Group, "dir/data.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, _ := io.ReadAll(f); string(b) != contents {
+		t.Fatalf("Unexpected contents of uploaded file: %q", string(b))
+	}
+
+	if resp := request("PATCH", filePath, strings.NewReader("more"), offset(len(contents))); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected uploads to a submitted group to be rejected, got %d", resp.Code)
+	}
+	// Submitting again links another task to the same files
+	if resp := request("POST", "/tasks/groups/"+created.Group+"/submit", strings.NewReader(testIndexSpec), nil); resp.Code != http.StatusOK {
+		t.Fatalf("Linking another task failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if record, _ := submitter.Metadata.Get(created.Group); len(record.LinkedTasks) != 1 || record.LinkedTasks[0].TaskID != "task-b" {
+		t.Fatalf("Expected second task to be linked to group, got %v", record.LinkedTasks)
+	}
+
+	resp = request("POST", "/tasks/groups", nil, nil)
+	json.NewDecoder(resp.Body).Decode(&created)
+	if resp := request("POST", "/tasks/groups/"+created.Group+"/submit", strings.NewReader(testIndexSpec), nil); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected empty group to be rejected, got %d", resp.Code)
+	}
+	if record, _ := submitter.Metadata.Get(created.Group); !record.Pending {
+		t.Fatalf("Expected rejected group to still accept uploads")
+	}
+	if resp := request("PATCH", "/tasks/groups/"+created.Group+"/files/a.json", strings.NewReader(`{"a": 1}`), offset(0)); resp.Code != http.StatusNoContent {
+		t.Fatalf("Upload failed: %d %s", resp.Code, resp.Body.String())
+	}
+	sql := "INSERT INTO test SELECT * FROM TABLE(EXTERN(" + InputSourcePlaceholder + ", '{}', '[]')) PARTITIONED BY DAY"
+	if resp := request("POST", "/tasks/groups/"+created.Group+"/sql", strings.NewReader(sql), nil); resp.Code != http.StatusOK {
+		t.Fatalf("Submitting SQL for group failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if len(overlord.queries) != 1 || !strings.Contains(overlord.queries[0].Query, created.Group+"/a.json") {
+		t.Fatalf("Unexpected SQL tasks %v", overlord.queries)
+	}
+
+	// Storage which can only write whole files cannot resume uploads
+	submitter.Files = struct{ FileManager }{submitter.Files}
+	mux = http.NewServeMux()
+	submitter.Handle(mux)
+	resp = request("POST", "/tasks/groups", nil, nil)
+	json.NewDecoder(resp.Body).Decode(&created)
+	if resp := request("PATCH", "/tasks/groups/"+created.Group+"/files/a.json", strings.NewReader(`{"a": 1}`), offset(0)); resp.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected resumable uploads to be unsupported, got %d", resp.Code)
+	}
+}
+
+func TestTwoPhaseUploads(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	// Whole files can be uploaded to any storage
+	submitter.Files = struct{ FileManager }{submitter.Files}
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	request := func(method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := request("POST", "/tasks/groups", nil, nil)
+	created := GroupCreated{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	groupPath := "/tasks/groups/" + created.Group
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = request("PUT", fmt.Sprintf("%s/files/part-%d.json", groupPath, i), strings.NewReader(fmt.Sprintf(`{"part": %d}`, i)), nil).Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusCreated {
+			t.Fatalf("Upload of part %d failed: %d", i, code)
+		}
+	}
+
+	// A file still being uploaded in parts keeps the group from being submitted
+	submitter.Files = submitter.Files.(struct{ FileManager }).FileManager
+	mux = http.NewServeMux()
+	submitter.Handle(mux)
+	headers := map[string]string{UploadOffsetHeader: "0", UploadLengthHeader: "8"}
+	if resp := request("PATCH", groupPath+"/files/last.json", strings.NewReader(`{"a"`), headers); resp.Code != http.StatusNoContent {
+		t.Fatalf("Partial upload failed: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = request("POST", groupPath+"/submit", strings.NewReader(testIndexSpec), nil)
+	if resp.Code != http.StatusConflict || !strings.Contains(resp.Body.String(), "last.json") {
+		t.Fatalf("Expected incomplete upload to block submission, got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request("HEAD", groupPath+"/files/last.json", nil, nil); resp.Header().Get(UploadOffsetHeader) != "4" || resp.Header().Get(UploadLengthHeader) != "8" {
+		t.Fatalf("Unexpected upload progress %v", resp.Header())
+	}
+	headers[UploadOffsetHeader] = "4"
+	if resp := request("PATCH", groupPath+"/files/last.json", strings.NewReader(`: 1}, too long`), headers); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected upload past Upload-Length to be rejected, got %d", resp.Code)
+	}
+	if resp := request("HEAD", groupPath+"/files/last.json", nil, nil); resp.Header().Get(UploadOffsetHeader) != "8" {
+		t.Fatalf("Expected upload to stop at Upload-Length, got %v", resp.Header())
+	}
+
+	resp = request("POST", groupPath+"/submit", strings.NewReader(testIndexSpec), nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if uris := submittedInputSource(t, overlord)["uris"].([]interface{}); len(uris) != 6 {
+		t.Fatalf("Expected every uploaded file to be ingested, got %v", uris)
+	}
+	record, _ := submitter.Metadata.Get(created.Group)
+	for _, file := range record.Files {
+		if len(file.SHA256) == 0 || file.Size == 0 {
+			t.Fatalf("Expected every file to be recorded, got %v", record.Files)
+		}
+	}
+	if resp := request("PUT", groupPath+"/files/late.json", strings.NewReader(`{}`), nil); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected uploads to a submitted group to be rejected, got %d", resp.Code)
+	}
+}
+
+func TestUploadRetention(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	tender := &FileTender{Files: submitter.Files, Metadata: submitter.Metadata, RetentionPeriod: time.Hour, HistoryPeriod: time.Hour}
+	groupExists := func(group string) bool {
+		groups, _ := submitter.Files.ListGroups()
+		_, ok := groups[group]
+		return ok
+	}
+
+	req := httptest.NewRequest("POST", "/tasks/groups", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	created := GroupCreated{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	// The upload has been going on for longer than the retention period
+	submitter.Metadata.Update(created.Group, func(record *GroupRecord) {
+		record.Created = time.Now().Add(-2 * time.Hour)
+	})
+	req = httptest.NewRequest("PATCH", "/tasks/groups/"+created.Group+"/files/data.json", strings.NewReader(`{"a": 1}`))
+	req.Header.Set(UploadOffsetHeader, "0")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Upload failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if errs := tender.RunRetentionCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(created.Group) {
+		t.Fatalf("Group deleted while it was still being uploaded to")
+	}
+
+	// A chunk which takes longer than the retention period to upload keeps the group too
+	submitter.Metadata.Update(created.Group, func(record *GroupRecord) {
+		record.LastUpload = time.Now().Add(-2 * time.Hour)
+		record.uploading++
+	})
+	if errs := tender.RunRetentionCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(created.Group) {
+		t.Fatalf("Group deleted during an upload")
+	}
+	submitter.Metadata.Update(created.Group, func(record *GroupRecord) {
+		record.uploading--
+	})
+	if errs := tender.RunRetentionCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if groupExists(created.Group) {
+		t.Fatalf("Abandoned upload not deleted after retention period")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sniffSize is how much of each file, after decompression, is read to infer its format
+const sniffSize = 64 * 1024
+
+// maxSniffedFiles is how many of the files of a submission are read to infer their format
+const maxSniffedFiles = 16
+
+// sniffedLines is how many lines of text files are compared to infer their delimiter and header
+const sniffedLines = 10
+
+// sniffDelimiters are the delimiters text files are checked for, most likely first
+var sniffDelimiters = []string{",", "\t", ";", "|"}
+
+// formatExtensions are the input formats implied by file extensions, for files whose contents are inconclusive
+var formatExtensions = map[string]string{
+	".json":    "json",
+	".jsonl":   "json",
+	".ndjson":  "json",
+	".csv":     "csv",
+	".tsv":     "tsv",
+	".parquet": "parquet",
+	".orc":     "orc",
+	".avro":    "avro_ocf",
+}
+
+// compressionExtensions are the extensions Druid decompresses files by
+var compressionExtensions = []string{".gz", ".bz2", ".xz", ".zip", ".sz", ".zst"}
+
+// sniffedFormat is the input format a file appears to have
+type sniffedFormat struct {
+	// Type is the Druid inputFormat type, or empty if the format could not be determined
+	Type string
+	// Delimiter is the delimiter of tsv files, which also covers delimiters other than tabs
+	Delimiter string
+	// Columns are the names given to the columns of csv and tsv files without a header
+	Columns []string
+	// Reason explains why the file appears to have this format
+	Reason string
+}
+
+// kind identifies formats which read files the same way, i.e. csv is tsv with a comma delimiter
+func (f *sniffedFormat) kind() string {
+	if f.Type == "csv" || f.Type == "tsv" {
+		return "delimited by " + strconv.Quote(f.Delimiter)
+	}
+	return f.Type
+}
+
+// InputFormat returns the Druid inputFormat for files with this format
+func (f *sniffedFormat) InputFormat() map[string]interface{} {
+	inputFormat := map[string]interface{}{"type": f.Type}
+	if f.Type == "tsv" && f.Delimiter != "\t" {
+		inputFormat["delimiter"] = f.Delimiter
+	}
+	if f.Type == "csv" || f.Type == "tsv" {
+		if len(f.Columns) != 0 {
+			inputFormat["columns"] = f.Columns
+		} else {
+			inputFormat["findColumnsFromHeader"] = true
+		}
+	}
+	return inputFormat
+}
+
+// declaredFormat returns the format of an inputFormat from a spec, or false if it is not one the gateway can infer
+func declaredFormat(inputFormat map[string]interface{}) (sniffedFormat, bool) {
+	declared := sniffedFormat{}
+	declared.Type, _ = inputFormat["type"].(string)
+	switch declared.Type {
+	case "csv":
+		declared.Delimiter = ","
+	case "tsv":
+		declared.Delimiter = "\t"
+		if delimiter, ok := inputFormat["delimiter"].(string); ok && len(delimiter) != 0 {
+			declared.Delimiter = delimiter
+		}
+	case "json", "parquet", "orc", "avro_ocf":
+	default:
+		return declared, false
+	}
+	return declared, true
+}
+
+// sampleFile reads the start of a file, decompressing it as Druid would, and returns it, and whether the rest of the file was cut off.
+// Druid decompresses files based on their names, so compressed files must be named for it.
+func sampleFile(name string, r io.Reader) ([]byte, bool, error) {
+	sample, err := io.ReadAll(io.LimitReader(r, sniffSize))
+	if err != nil {
+		return nil, false, err
+	}
+	truncated := len(sample) == sniffSize
+	lowerName := strings.ToLower(name)
+	var decompressed io.Reader
+	switch {
+	case bytes.HasPrefix(sample, []byte{0x1f, 0x8b}):
+		if !strings.HasSuffix(lowerName, ".gz") {
+			return nil, false, errBadFiles{fmt.Errorf("%s is gzip-compressed, but its name does not end in .gz, so Druid would not decompress it", name)}
+		}
+		decompressed, err = gzip.NewReader(bytes.NewReader(sample))
+		if err != nil {
+			return nil, false, errBadFiles{fmt.Errorf("%s is not valid gzip: %s", name, err)}
+		}
+	case bytes.HasPrefix(sample, []byte("BZh")) && strings.HasSuffix(lowerName, ".bz2"):
+		decompressed = bzip2.NewReader(bytes.NewReader(sample))
+	}
+	if decompressed != nil {
+		// Only the start of the file was read, so the end of the compressed stream is missing
+		sample, _ = io.ReadAll(io.LimitReader(decompressed, sniffSize))
+		truncated = true
+	}
+	return sample, truncated, nil
+}
+
+// errBadFiles is returned when files cannot be ingested as their spec describes, rather than failing to read them
+type errBadFiles struct {
+	err error
+}
+
+func (e errBadFiles) Error() string {
+	return e.err.Error()
+}
+
+// SniffInputFormat infers the format of a file from the start of its contents, and its name
+func SniffInputFormat(name string, r io.Reader) (sniffedFormat, error) {
+	sample, truncated, err := sampleFile(name, r)
+	if err != nil {
+		return sniffedFormat{}, err
+	}
+	lowerName := strings.ToLower(name)
+	for _, ext := range compressionExtensions {
+		if strings.HasSuffix(lowerName, ext) {
+			lowerName = strings.TrimSuffix(lowerName, ext)
+			break
+		}
+	}
+	fromExtension := sniffedFormat{Type: formatExtensions[path.Ext(lowerName)], Reason: "its name ends in " + path.Ext(lowerName)}
+	switch fromExtension.Type {
+	case "csv":
+		fromExtension.Delimiter = ","
+	case "tsv":
+		fromExtension.Delimiter = "\t"
+	}
+
+	switch {
+	case bytes.HasPrefix(sample, []byte("PAR1")):
+		return sniffedFormat{Type: "parquet", Reason: "it starts with the Parquet magic number"}, nil
+	case bytes.HasPrefix(sample, []byte("ORC")):
+		return sniffedFormat{Type: "orc", Reason: "it starts with the ORC magic number"}, nil
+	case bytes.HasPrefix(sample, []byte("Obj\x01")):
+		return sniffedFormat{Type: "avro_ocf", Reason: "it starts with the Avro object container file magic number"}, nil
+	case bytes.IndexByte(sample, 0) != -1:
+		// Some other binary format
+		return sniffedFormat{}, nil
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(sample, []byte("\xef\xbb\xbf"))))
+	scanner.Buffer(make([]byte, 0, sniffSize), sniffSize+1)
+	for scanner.Scan() && len(lines) <= sniffedLines {
+		if line := strings.TrimRight(scanner.Text(), "\r"); len(strings.TrimSpace(line)) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	// The last line may have been cut off
+	if truncated && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > sniffedLines {
+		lines = lines[:sniffedLines]
+	}
+	if len(lines) == 0 {
+		return fromExtension, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(lines[0]), "{") {
+		return sniffedFormat{Type: "json", Reason: "it starts with a JSON object"}, nil
+	}
+
+	var rows [][]string
+	var delimiter string
+	for _, candidate := range sniffDelimiters {
+		candidateRows, ok := splitRows(lines, candidate)
+		if ok && (rows == nil || len(candidateRows[0]) > len(rows[0])) {
+			rows = candidateRows
+			delimiter = candidate
+		}
+	}
+	if rows == nil {
+		return fromExtension, nil
+	}
+	format := sniffedFormat{Type: "tsv", Delimiter: delimiter, Reason: fmt.Sprintf("its lines have %d fields delimited by %q", len(rows[0]), delimiter)}
+	if delimiter == "," {
+		format.Type = "csv"
+	}
+	if !looksLikeHeader(rows[0]) {
+		for i := range rows[0] {
+			format.Columns = append(format.Columns, fmt.Sprintf("column_%d", i+1))
+		}
+	}
+	return format, nil
+}
+
+// splitRows splits lines of text by a delimiter, and returns false unless every line has the same number of fields, and more than one
+func splitRows(lines []string, delimiter string) ([][]string, bool) {
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.Comma = []rune(delimiter)[0]
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil || len(rows) == 0 || len(rows[0]) < 2 {
+		return nil, false
+	}
+	return rows, true
+}
+
+// looksLikeHeader returns true if a row appears to be column names, i.e. distinct, and neither empty nor numbers
+func looksLikeHeader(row []string) bool {
+	seen := map[string]bool{}
+	for _, field := range row {
+		field = strings.TrimSpace(field)
+		if _, err := strconv.ParseFloat(field, 64); err == nil || len(field) == 0 || seen[field] {
+			return false
+		}
+		seen[field] = true
+	}
+	return true
+}
+
+// inferInputFormat sets the inputFormat of a native task from the files it ingests, if it has none, or otherwise checks that
+// it matches them. If it cannot be inferred, or does not match, the error is an errBadFiles.
+func inferInputFormat(taskSpec, ioConfig map[string]interface{}, group string, items []string, open func(item string) (io.ReadCloser, error)) error {
+	// Specs with a legacy parser describe their format there instead
+	spec, _ := taskSpec["spec"].(map[string]interface{})
+	dataSchema, _ := spec["dataSchema"].(map[string]interface{})
+	if _, ok := dataSchema["parser"]; ok {
+		return nil
+	}
+	inputFormat, declared := ioConfig["inputFormat"].(map[string]interface{})
+	expected, checkable := declaredFormat(inputFormat)
+	if declared && !checkable {
+		return nil
+	}
+
+	var inferred *sniffedFormat
+	var inferredFrom string
+	for i, item := range items {
+		if i == maxSniffedFiles {
+			break
+		}
+		f, err := open(item)
+		if err != nil {
+			return err
+		}
+		format, err := SniffInputFormat(item, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if len(format.Type) == 0 {
+			continue
+		}
+		if declared && format.kind() != expected.kind() {
+			return errBadFiles{fmt.Errorf("spec.ioConfig.inputFormat is %s, but %s looks like %s, because %s", expected.kind(), item, format.kind(), format.Reason)}
+		}
+		if inferred == nil {
+			inferred = &format
+			inferredFrom = item
+		} else if format.kind() != inferred.kind() {
+			return errBadFiles{fmt.Errorf("Files have different formats, %s looks like %s, but %s looks like %s, submit them separately", inferredFrom, inferred.kind(), item, format.kind())}
+		}
+	}
+	if declared {
+		return nil
+	}
+	if inferred == nil {
+		return errBadFiles{fmt.Errorf("Could not infer the format of the files, set spec.ioConfig.inputFormat")}
+	}
+	fmt.Printf("Inferred inputFormat %s for group %s from %s, because %s\n", inferred.Type, group, inferredFrom, inferred.Reason)
+	ioConfig["inputFormat"] = inferred.InputFormat()
+	return nil
+}
+
+// filesCheckFailed sends the response for an error from checking the files of a submission against its spec
+func filesCheckFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(errBadFiles); ok {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fmt.Println(err)
+	ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+}
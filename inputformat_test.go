@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func gzipped(contents string) string {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	writer.Write([]byte(contents))
+	writer.Close()
+	return buf.String()
+}
+
+func TestSniffInputFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents string
+		expected map[string]interface{}
+	}{
+		{"events.json", `{"a": 1}` + "\n" + `{"a": 2}`, map[string]interface{}{"type": "json"}},
+		{"events", `  {"a": 1}`, map[string]interface{}{"type": "json"}},
+		{"events.json.gz", gzipped(`{"a": 1}` + "\n"), map[string]interface{}{"type": "json"}},
+		{"events.csv", "time,page,count\n2020-01-01,a,1\n2020-01-02,\"b,c\",2\n", map[string]interface{}{"type": "csv", "findColumnsFromHeader": true}},
+		{"events.txt", "2020-01-01,a,1\n2020-01-02,b,2\n", map[string]interface{}{"type": "csv", "columns": []string{"column_1", "column_2", "column_3"}}},
+		{"events.tsv", "time\tpage\n2020-01-01\ta\n", map[string]interface{}{"type": "tsv", "findColumnsFromHeader": true}},
+		{"events.csv", "time;page\n2020-01-01;a\n", map[string]interface{}{"type": "tsv", "delimiter": ";", "findColumnsFromHeader": true}},
+		{"events.csv", "time\n2020-01-01\n", map[string]interface{}{"type": "csv", "findColumnsFromHeader": true}},
+		{"part-0.snappy.parquet", "PAR1\x15\x00", map[string]interface{}{"type": "parquet"}},
+		{"part-0", "ORC\x0a\x00", map[string]interface{}{"type": "orc"}},
+		{"events.avro", "Obj\x01\x04\x14", map[string]interface{}{"type": "avro_ocf"}},
+		{"events.bin", "\x00\x01\x02", nil},
+	} {
+		format, err := SniffInputFormat(tc.name, strings.NewReader(tc.contents))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if tc.expected == nil {
+			if len(format.Type) != 0 {
+				t.Fatalf("%s: expected no format, got %v", tc.name, format)
+			}
+			continue
+		}
+		if inputFormat := format.InputFormat(); !reflect.DeepEqual(inputFormat, tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, inputFormat)
+		}
+	}
+	if _, err := SniffInputFormat("events.json", strings.NewReader(gzipped(`{"a": 1}`))); err == nil {
+		t.Fatalf("Expected gzipped file without .gz to be rejected")
+	}
+}
+
+func TestInputFormatInference(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	submit := func(spec string, files map[string]string) (int, string) {
+		mux := http.NewServeMux()
+		submitter.Handle(mux)
+		body, contentType := buildSubmission(t, spec, files)
+		req, _ := http.NewRequest("POST", "/tasks/task", body)
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp.Code, resp.Body.String()
+	}
+	lastInputFormat := func() string {
+		overlord.lock.Lock()
+		defer overlord.lock.Unlock()
+		ioConfig := overlord.specs[len(overlord.specs)-1]["spec"].(map[string]interface{})["ioConfig"].(map[string]interface{})
+		inputFormat, _ := json.Marshal(ioConfig["inputFormat"])
+		return string(inputFormat)
+	}
+
+	if code, body := submit(testIndexSpec, map[string]string{"a.csv": "time,page\n1,a\n", "b.csv": "time,page\n2,b\n"}); code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", code, body)
+	}
+	if inputFormat := lastInputFormat(); inputFormat != `{"findColumnsFromHeader":true,"type":"csv"}` {
+		t.Fatalf("Unexpected inferred inputFormat %s", inputFormat)
+	}
+
+	csvSpec := `{"type": "index_parallel", "spec": {"dataSchema": {"dataSource": "test"}, "ioConfig": {"type": "index_parallel", "inputFormat": {"type": "csv", "findColumnsFromHeader": true}}}}`
+	if code, body := submit(csvSpec, map[string]string{"a.csv": "time,page\n1,a\n"}); code != http.StatusOK {
+		t.Fatalf("Submission with matching inputFormat failed: %d %s", code, body)
+	}
+	if code, body := submit(csvSpec, map[string]string{"a.json": `{"time": 1}`}); code != http.StatusBadRequest || !strings.Contains(body, "a.json looks like json") {
+		t.Fatalf("Expected contradicting inputFormat to be rejected, got %d %s", code, body)
+	}
+	if code, body := submit(testIndexSpec, map[string]string{"a.json": `{"time": 1}`, "b.csv": "time,page\n1,a\n"}); code != http.StatusBadRequest || !strings.Contains(body, "different formats") {
+		t.Fatalf("Expected files with different formats to be rejected, got %d %s", code, body)
+	}
+	if code, _ := submit(testIndexSpec, map[string]string{"a.bin": "\x00\x01"}); code != http.StatusBadRequest {
+		t.Fatalf("Expected files of unknown format to be rejected, got %d", code)
+	}
+	// Formats the gateway does not know are left to Druid
+	regexSpec := `{"type": "index_parallel", "spec": {"dataSchema": {"dataSource": "test"}, "ioConfig": {"type": "index_parallel", "inputFormat": {"type": "regex", "pattern": "(.*)"}}}}`
+	if code, body := submit(regexSpec, map[string]string{"a.json": `{"time": 1}`}); code != http.StatusOK {
+		t.Fatalf("Submission with unchecked inputFormat failed: %d %s", code, body)
+	}
+	if records := submitter.Metadata.List(); len(records) != 3 {
+		t.Fatalf("Expected rejected submissions to be discarded, got %d groups", len(records))
+	}
+}
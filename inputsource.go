@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+// InputSource builds the Druid inputSource which reads a group of submitted files
+type InputSource interface {
+	InputSource(group string, items []string) (map[string]interface{}, error)
+}
+
+// HTTPInputSource has Druid fetch submitted files from the Retriever
+type HTTPInputSource struct {
+	FetchURLBase url.URL
+	// Signer, if set, signs each URL so that the Retriever can verify it
+	Signer *URLSigner
+	// Credentials, if set, are given to Druid to fetch files with, and checked by the Retriever
+	Credentials FetchCredentials
+}
+
+func (h *HTTPInputSource) InputSource(group string, items []string) (map[string]interface{}, error) {
+	uris := make([]string, 0, len(items))
+	var expires time.Time
+	if h.Signer != nil {
+		expires = time.Now().Add(h.Signer.TTL)
+	}
+	for _, item := range items {
+		fetchURL := h.FetchURLBase
+		if h.Signer != nil {
+			fetchURL.Path += h.Signer.SignedPath(group, item, expires)
+		} else {
+			fetchURL.Path += group + "/" + item
+		}
+		uris = append(uris, fetchURL.String())
+	}
+	inputSource := map[string]interface{}{}
+	inputSource["type"] = "http"
+	inputSource["uris"] = uris
+	if h.Credentials != nil {
+		username, password, err := h.Credentials.Credentials(group)
+		if err != nil {
+			return nil, err
+		}
+		inputSource["httpAuthenticationUsername"] = username
+		inputSource["httpAuthenticationPassword"] = password
+	}
+	return inputSource, nil
+}
+
+// S3InputSource has Druid read submitted files directly from the bucket they are stored in,
+// bypassing the Retriever entirely. The Druid cluster must have the druid-s3-extensions extension loaded,
+// and credentials to read the bucket.
+type S3InputSource struct {
+	Files *S3FileManager
+	// UsePrefixes lists the group's prefix instead of each object
+	UsePrefixes bool
+	// IncludeEndpoint sets the endpoint and addressing style for the inputSource instead of relying on the
+	// Druid cluster's S3 configuration, for Druid versions which support it
+	IncludeEndpoint bool
+}
+
+func (s *S3InputSource) InputSource(group string, items []string) (map[string]interface{}, error) {
+	inputSource := map[string]interface{}{}
+	inputSource["type"] = "s3"
+	if s.UsePrefixes {
+		inputSource["prefixes"] = []string{"s3://" + s.Files.Bucket + "/" + s.Files.key(group, "")}
+	} else {
+		objects := make([]map[string]string, 0, len(items))
+		for _, item := range items {
+			objects = append(objects, map[string]string{
+				"bucket": s.Files.Bucket,
+				"path":   s.Files.key(group, item),
+			})
+		}
+		inputSource["objects"] = objects
+	}
+	if s.IncludeEndpoint {
+		inputSource["endpointConfig"] = map[string]string{
+			"url":           s.Files.Endpoint.String(),
+			"signingRegion": s.Files.Region,
+		}
+		inputSource["clientConfig"] = map[string]interface{}{
+			"enablePathStyleAccess": s.Files.PathStyle,
+			"protocol":              s.Files.Endpoint.Scheme,
+		}
+	}
+	return inputSource, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func submitTestTask(t *testing.T, submitter *Submitter, files map[string]string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	body, contentType := buildSubmission(t, testIndexSpec, files)
+	req := httptest.NewRequest("POST", "/tasks/task", body)
+	req.Header.Set("Content-Type", contentType)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func submittedInputSource(t *testing.T, overlord *fakeOverlord) map[string]interface{} {
+	if len(overlord.specs) != 1 {
+		t.Fatalf("Expected one task to be submitted, got %d", len(overlord.specs))
+	}
+	spec := overlord.specs[0]["spec"].(map[string]interface{})
+	ioConfig := spec["ioConfig"].(map[string]interface{})
+	return ioConfig["inputSource"].(map[string]interface{})
+}
+
+func TestHTTPInputSource(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	inputSource := submittedInputSource(t, overlord)
+	if inputSource["type"] != "http" {
+		t.Fatalf("Expected http input source, got %v", inputSource)
+	}
+	uris := inputSource["uris"].([]interface{})
+	if len(uris) != 1 {
+		t.Fatalf("Expected one URI, got %v", uris)
+	}
+	uri, err := url.Parse(uris[0].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Host != "gateway" || !strings.HasPrefix(uri.Path, "/files/file/") || !strings.HasSuffix(uri.Path, "/data.json") {
+		t.Fatalf("URI does not point to the Retriever: %s", uri)
+	}
+}
+
+func TestS3InputSource(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	files, store := newTestS3FileManager(t)
+	submitter.Files = files
+	submitter.InputSource = &S3InputSource{Files: files}
+
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	inputSource := submittedInputSource(t, overlord)
+	if inputSource["type"] != "s3" {
+		t.Fatalf("Expected s3 input source, got %v", inputSource)
+	}
+	objects := inputSource["objects"].([]interface{})
+	if len(objects) != 1 {
+		t.Fatalf("Expected one object, got %v", objects)
+	}
+	object := objects[0].(map[string]interface{})
+	if object["bucket"] != "bucket" {
+		t.Fatalf("Wrong bucket: %v", object)
+	}
+	if _, ok := store.objects[object["path"].(string)]; !ok {
+		t.Fatalf("Input source refers to %s, which was not uploaded", object["path"])
+	}
+
+	submitter.InputSource = &S3InputSource{Files: files, UsePrefixes: true}
+	inputSource, err := submitter.InputSource.InputSource("group", []string{"data.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := inputSource["prefixes"]
+	if !reflect.DeepEqual(prefixes, []string{"s3://bucket/uploads/group/"}) {
+		t.Fatalf("Unexpected prefixes %v", prefixes)
+	}
+}
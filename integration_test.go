@@ -359,7 +359,7 @@ func Test(t *testing.T) {
 	druidStartupIsDumb(t, "http://127.0.0.1:8888/druid/indexer/v1/task")
 
 	t.Log("Starting Druid Index Gateway...")
-	indexGateway := exec.Command("go", "run", "main.go", "--tasks-addr", ":8180", "--files-addr", ":8180", "--root-dir", "tmp/files")
+	indexGateway := exec.Command("go", "run", ".", "--tasks-addr", ":8180", "--files-addr", ":8180", "--root-dir", "tmp/files")
 	err = captureLogs(t, indexGateway, "index gateway says:")
 	if err != nil {
 		t.Log("Failed to start Druid Index Gateway", err)
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWK is a single key from a JSON Web Key Set. Only RSA and EC public keys are supported.
+type JWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %s", k.KeyType)
+	}
+}
+
+// JWTAuthenticator authenticates requests with a bearer JWT signed by one of a set of keys.
+// The subject of the token is the principal.
+type JWTAuthenticator struct {
+	Keys map[string]crypto.PublicKey
+	// Issuer and Audience, if set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim listing the principal's roles, either as an array or a space-separated string
+	RolesClaim string
+}
+
+// LoadJWKS reads the keys of a JSON Web Key Set file
+func LoadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jwks := struct {
+		Keys []JWK `json:"keys"`
+	}{}
+	err = json.NewDecoder(f).Decode(&jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %s: %s", path, jwk.KeyID, err)
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifyJWTSignature checks the signature of a token's header and payload with a key for the alg in its header
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported algorithm %s", alg)
+	}
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("Unsupported algorithm %s", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+	switch alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Algorithm %s requires an RSA key", alg)
+		}
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(rsaKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature)
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Algorithm %s requires an EC key", alg)
+		}
+		// JWS ECDSA signatures are the big-endian r and s concatenated, not ASN.1
+		if len(signature)%2 != 0 {
+			return fmt.Errorf("Malformed signature")
+		}
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported algorithm %s", alg)
+	}
+}
+
+// stringsClaim reads a claim which may be a single string, or an array of strings
+func stringsClaim(claim interface{}, separator string) []string {
+	switch value := claim.(type) {
+	case string:
+		if len(separator) == 0 {
+			return []string{value}
+		}
+		return strings.Fields(value)
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// Verify checks a token's signature and claims, and returns the principal it authenticates
+func (j *JWTAuthenticator) Verify(token string, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, fmt.Errorf("Malformed token")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Principal{}, err
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return Principal{}, err
+	}
+	key, ok := j.Keys[header.Kid]
+	if !ok {
+		return Principal{}, fmt.Errorf("Unknown key %s", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, err
+	}
+	err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Principal{}, err
+	}
+	claims := map[string]interface{}{}
+	err = json.Unmarshal(claimsBytes, &claims)
+	if err != nil {
+		return Principal{}, err
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Unix() >= int64(exp) {
+		return Principal{}, fmt.Errorf("Token is expired or has no expiry")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return Principal{}, fmt.Errorf("Token is not yet valid")
+	}
+	if len(j.Issuer) != 0 && claims["iss"] != j.Issuer {
+		return Principal{}, fmt.Errorf("Wrong issuer %v", claims["iss"])
+	}
+	if len(j.Audience) != 0 {
+		found := false
+		for _, audience := range stringsClaim(claims["aud"], "") {
+			found = found || audience == j.Audience
+		}
+		if !found {
+			return Principal{}, fmt.Errorf("Wrong audience %v", claims["aud"])
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	if len(subject) == 0 {
+		return Principal{}, fmt.Errorf("Token has no subject")
+	}
+	return Principal{Name: subject, Roles: stringsClaim(claims[j.RolesClaim], " ")}, nil
+}
+
+func (j *JWTAuthenticator) Authenticate(r *http.Request) (Principal, bool, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return Principal{}, false, nil
+	}
+	principal, err := j.Verify(strings.TrimPrefix(authorization, "Bearer "), time.Now())
+	return principal, true, err
+}
+
+func (j *JWTAuthenticator) Challenge() string {
+	return "Bearer"
+}
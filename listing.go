@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+const BadListMsg = "limit and offset must be non-negative integers, limit must be at most 1000, and minAge and maxAge must be durations, e.g. 90m"
+
+// GroupSummary describes a group of files in a listing
+type GroupSummary struct {
+	Group      string     `json:"group"`
+	Created    time.Time  `json:"created"`
+	Client     string     `json:"client"`
+	Owner      string     `json:"owner,omitempty"`
+	DataSource string     `json:"dataSource,omitempty"`
+	FileCount  int        `json:"fileCount"`
+	TotalSize  int64      `json:"totalSize"`
+	TaskID     string     `json:"taskId,omitempty"`
+	TaskStatus string     `json:"taskStatus,omitempty"`
+	Expires    time.Time  `json:"expires"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+	// Pending is true while files are being uploaded, before a task has been submitted
+	Pending bool `json:"pending,omitempty"`
+	// LinkedTasks are the tasks submitted for the files after the first
+	LinkedTasks []TaskRecord `json:"linkedTasks,omitempty"`
+	// Keep is true if the files are kept for more tasks until they expire, instead of being deleted once every task has finished
+	Keep bool `json:"keep,omitempty"`
+}
+
+// GroupDetail describes a group of files, and each file in it
+type GroupDetail struct {
+	GroupSummary
+	Files []FileRecord `json:"files"`
+}
+
+// GroupList is a page of groups
+type GroupList struct {
+	Groups []GroupSummary `json:"groups"`
+	// Total is the number of groups which matched the filters, across all pages
+	Total int `json:"total"`
+	// NextOffset is the offset of the next page, or omitted if this is the last page
+	NextOffset int `json:"nextOffset,omitempty"`
+}
+
+func (s *Submitter) summarize(record *GroupRecord) GroupSummary {
+	summary := GroupSummary{
+		Group:      record.Group,
+		Created:    record.Created,
+		Client:     record.Client,
+		Owner:      record.Owner,
+		DataSource: record.DataSource,
+		FileCount:  len(record.Files),
+		TaskID:     record.TaskID,
+		TaskStatus: record.TaskStatus,
+		Expires:    record.LastActive().Add(s.RetentionPeriod),
+		Pending:    record.Pending,
+		Keep:       record.Keep,
+	}
+	if len(record.LinkedTasks) != 0 {
+		summary.LinkedTasks = record.LinkedTasks
+	}
+	if !record.Deleted.IsZero() {
+		deleted := record.Deleted
+		summary.Deleted = &deleted
+	}
+	for _, file := range record.Files {
+		summary.TotalSize += file.Size
+	}
+	return summary
+}
+
+func queryInt(query map[string][]string, name string, defaultValue int) (int, error) {
+	values, ok := query[name]
+	if !ok || len(values) == 0 {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(values[0])
+}
+
+func queryDuration(query map[string][]string, name string) (time.Duration, error) {
+	values, ok := query[name]
+	if !ok || len(values) == 0 {
+		return 0, nil
+	}
+	return time.ParseDuration(values[0])
+}
+
+// List lists groups, oldest first.
+// Groups whose files were deleted are only included with includeDeleted=true.
+// Principals only see their own groups, unless they are an admin.
+func (s *Submitter) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := queryInt(query, "limit", DefaultListLimit)
+	if err != nil || limit < 0 || limit > MaxListLimit {
+		ErrorResponse(w, http.StatusBadRequest, BadListMsg)
+		return
+	}
+	offset, err := queryInt(query, "offset", 0)
+	if err != nil || offset < 0 {
+		ErrorResponse(w, http.StatusBadRequest, BadListMsg)
+		return
+	}
+	minAge, err := queryDuration(query, "minAge")
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, BadListMsg)
+		return
+	}
+	maxAge, err := queryDuration(query, "maxAge")
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, BadListMsg)
+		return
+	}
+	dataSource := query.Get("dataSource")
+	includeDeleted := query.Get("includeDeleted") == "true"
+
+	now := time.Now()
+	matched := []GroupSummary{}
+	for _, record := range s.Metadata.List() {
+		age := now.Sub(record.Created)
+		if s.Auth != nil && !s.Auth.CanAccess(principalOf(r), &record) {
+			continue
+		}
+		if !includeDeleted && !record.Deleted.IsZero() {
+			continue
+		}
+		if len(dataSource) != 0 && record.DataSource != dataSource {
+			continue
+		}
+		if age < minAge || (maxAge != 0 && age > maxAge) {
+			continue
+		}
+		matched = append(matched, s.summarize(&record))
+	}
+
+	list := GroupList{Groups: []GroupSummary{}, Total: len(matched)}
+	if offset < len(matched) {
+		end := offset + limit
+		if end < len(matched) {
+			list.NextOffset = end
+		} else {
+			end = len(matched)
+		}
+		list.Groups = matched[offset:end]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Describe lists the files in a group
+func (s *Submitter) Describe(w http.ResponseWriter, r *http.Request) {
+	group := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, s.ContextPath+SubmitterEndpoint), "/")
+	record, ok := s.Metadata.Get(group)
+	if !ok {
+		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
+		return
+	}
+	if s.Auth != nil && !s.Auth.CanAccess(principalOf(r), &record) {
+		ErrorResponse(w, http.StatusForbidden, NotOwnerMsg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GroupDetail{GroupSummary: s.summarize(&record), Files: record.Files})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, mux *http.ServeMux, path string, expectedCode int, into interface{}) {
+	req := httptest.NewRequest("GET", path, nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != expectedCode {
+		t.Fatalf("GET %s: expected %d, got %d %s", path, expectedCode, resp.Code, resp.Body.String())
+	}
+	if into != nil {
+		err := json.Unmarshal(resp.Body.Bytes(), into)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	submitter.RetentionPeriod = time.Hour
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	for i := 0; i < 3; i++ {
+		resp := submitTestTask(t, submitter, map[string]string{"a.json": `{"a": 1}`, "b.json": `{"b": 22}`})
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+		}
+	}
+	records := submitter.Metadata.List()
+	submitter.Metadata.Update(records[0].Group, func(record *GroupRecord) {
+		record.Created = record.Created.Add(-30 * time.Minute)
+		record.DataSource = "other"
+	})
+	submitter.Metadata.Update(records[2].Group, func(record *GroupRecord) {
+		record.Deleted = time.Now()
+	})
+
+	list := GroupList{}
+	getJSON(t, mux, "/tasks/task", http.StatusOK, &list)
+	if list.Total != 2 || len(list.Groups) != 2 || list.NextOffset != 0 {
+		t.Fatalf("Expected two undeleted groups, got %#v", list)
+	}
+	summary := list.Groups[0]
+	if summary.Group != records[0].Group || summary.FileCount != 2 || summary.TotalSize != 17 || summary.TaskID == "" {
+		t.Fatalf("Unexpected summary %#v", summary)
+	}
+	if !summary.Expires.Equal(summary.Created.Add(time.Hour)) {
+		t.Fatalf("Unexpected expiry %v for group created at %v", summary.Expires, summary.Created)
+	}
+
+	list = GroupList{}
+	getJSON(t, mux, "/tasks/task?limit=1", http.StatusOK, &list)
+	if list.Total != 2 || len(list.Groups) != 1 || list.NextOffset != 1 {
+		t.Fatalf("Expected first page, got %#v", list)
+	}
+	list = GroupList{}
+	getJSON(t, mux, "/tasks/task?limit=1&offset=1", http.StatusOK, &list)
+	if len(list.Groups) != 1 || list.Groups[0].Group != records[1].Group || list.NextOffset != 0 {
+		t.Fatalf("Expected last page, got %#v", list)
+	}
+	list = GroupList{}
+	getJSON(t, mux, "/tasks/task?includeDeleted=true", http.StatusOK, &list)
+	if list.Total != 3 || list.Groups[2].Deleted == nil {
+		t.Fatalf("Expected deleted group, got %#v", list)
+	}
+	list = GroupList{}
+	getJSON(t, mux, "/tasks/task?dataSource=other", http.StatusOK, &list)
+	if list.Total != 1 || list.Groups[0].Group != records[0].Group {
+		t.Fatalf("Expected group filtered by datasource, got %#v", list)
+	}
+	list = GroupList{}
+	getJSON(t, mux, "/tasks/task?minAge=15m", http.StatusOK, &list)
+	if list.Total != 1 || list.Groups[0].Group != records[0].Group {
+		t.Fatalf("Expected group filtered by minimum age, got %#v", list)
+	}
+	list = GroupList{}
+	getJSON(t, mux, "/tasks/task?maxAge=15m", http.StatusOK, &list)
+	if list.Total != 1 || list.Groups[0].Group != records[1].Group {
+		t.Fatalf("Expected group filtered by maximum age, got %#v", list)
+	}
+	getJSON(t, mux, "/tasks/task?minAge=soon", http.StatusBadRequest, nil)
+	getJSON(t, mux, "/tasks/task?limit=-1", http.StatusBadRequest, nil)
+
+	detail := GroupDetail{}
+	getJSON(t, mux, "/tasks/task/"+records[1].Group, http.StatusOK, &detail)
+	if detail.Group != records[1].Group || len(detail.Files) != 2 || detail.Files[0].SHA256 == "" {
+		t.Fatalf("Unexpected detail %#v", detail)
+	}
+	getJSON(t, mux, "/tasks/task/unknown", http.StatusNotFound, nil)
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
-	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	flag "github.com/spf13/pflag"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,145 +29,185 @@ func ErrorResponse(w http.ResponseWriter, statusCode int, msg string) {
 	// Should probably log this if it fails?
 }
 
-func MaliciousPath(path string) bool {
-	// TODO: Check if path has more ..'s than it has parts, i.e. path escapes root
-	return path == "." || path == ".." || strings.HasPrefix(path, "../")
+// HiddenGroup returns true for names under the root directory which hold gateway state instead of files
+func HiddenGroup(group string) bool {
+	return strings.HasPrefix(group, ".")
+}
+
+// MaliciousPath returns true for paths which are absolute, or which do not stay below the directory they are relative to
+func MaliciousPath(p string) bool {
+	cleaned := path.Clean(p)
+	return strings.HasPrefix(p, "/") || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+// submittedFilename returns the name to store a submitted file under, and false if it is empty or malicious
+func submittedFilename(name string) (string, bool) {
+	filename := strings.TrimPrefix(strings.TrimPrefix(name, "/"), "./")
+	return filename, len(filename) != 0 && !MaliciousPath(filename)
 }
 
 type TLSConfig struct {
 	CertFile string
 	KeyFile  string
+	// ClientCAFile, if set, requires clients to present a certificate signed by one of the CAs in this file
+	ClientCAFile string
+	// AllowedSubjects and AllowedSANs, if either is set, require client certificates to have a subject
+	// (either the common name or the full distinguished name) or subject alternative name matching one of these patterns
+	AllowedSubjects []string
+	AllowedSANs     []string
 }
 
-func ParseTLSConfig(certPath, keyPath string) (*TLSConfig, error) {
+func ParseTLSConfig(certPath, keyPath, clientCAPath string, allowedSubjects, allowedSANs []string) (*TLSConfig, error) {
 	if len(certPath) == 0 && len(keyPath) == 0 {
+		if len(clientCAPath) != 0 || len(allowedSubjects) != 0 || len(allowedSANs) != 0 {
+			return nil, fmt.Errorf("Client certificates can only be verified if a TLS key and cert are specified")
+		}
 		return nil, nil
 	}
-	if len(certPath) != 0 && len(keyPath) != 0 {
-		return &TLSConfig{CertFile: certPath, KeyFile: keyPath}, nil
+	if len(certPath) == 0 || len(keyPath) == 0 {
+		return nil, fmt.Errorf("Must specify both TLS key and cert, or neither")
 	}
-	return nil, fmt.Errorf("Must specify both TLS key and cert, or neither")
-}
-
-type Server struct {
-	ListenAddr string
-	TLS        *TLSConfig
-}
-
-func (s *Server) ListenAndServe(handler http.Handler) error {
-	if s.TLS == nil {
-		return http.ListenAndServe(s.ListenAddr, handler)
-	} else {
-		return http.ListenAndServeTLS(s.ListenAddr, s.TLS.CertFile, s.TLS.KeyFile, handler)
+	if len(clientCAPath) == 0 && (len(allowedSubjects) != 0 || len(allowedSANs) != 0) {
+		return nil, fmt.Errorf("Must specify a client CA to allow client certificate subjects or SANs")
 	}
+	for _, pattern := range append(append([]string{}, allowedSubjects...), allowedSANs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Bad client certificate pattern %s: %s", pattern, err)
+		}
+	}
+	return &TLSConfig{
+		CertFile:        certPath,
+		KeyFile:         keyPath,
+		ClientCAFile:    clientCAPath,
+		AllowedSubjects: allowedSubjects,
+		AllowedSANs:     allowedSANs,
+	}, nil
 }
 
-type FileManager struct {
-	RootDir string
-	// TODO: Create symlink based on index task id returned from druid to uuid-based directory name, clean up underlying directory when symlink is requested to be deleted
-}
-
-func (f *FileManager) Init() error {
-	return os.MkdirAll(f.RootDir, 0700)
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (fm *FileManager) Put(group, itemName string, itemContents io.Reader) error {
-	err := os.MkdirAll(path.Join(fm.RootDir, group), 0700)
-	if err != nil {
-		return err
+// verifyClient checks a verified client certificate against the allowed subjects and SANs
+func (t *TLSConfig) verifyClient(state tls.ConnectionState) error {
+	if len(t.AllowedSubjects) == 0 && len(t.AllowedSANs) == 0 {
+		return nil
 	}
-	f, err := os.Create(path.Join(fm.RootDir, group, itemName))
-	if err != nil {
-		return err
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("No verified client certificate")
 	}
-	defer f.Close()
-	io.Copy(f, itemContents)
-	return nil
-}
-
-func (f *FileManager) Get(group, item string) (io.Reader, error) {
-	return os.Open(path.Join(f.RootDir, group, item))
-}
-
-func (f *FileManager) Delete(group string) error {
-	return os.RemoveAll(path.Join(f.RootDir, group))
+	cert := state.VerifiedChains[0][0]
+	if matchesAny(t.AllowedSubjects, cert.Subject.CommonName, cert.Subject.String()) {
+		return nil
+	}
+	sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	if matchesAny(t.AllowedSANs, sans...) {
+		return nil
+	}
+	return fmt.Errorf("Client certificate %s is not allowed", cert.Subject)
 }
 
-func (f *FileManager) ListGroups() (map[string]os.FileInfo, error) {
-	dir, err := os.Open(f.RootDir)
-	if err != nil {
-		return nil, err
+// Config builds the tls.Config to serve with. The certificate and key are loaded separately by the server.
+func (t *TLSConfig) Config() (*tls.Config, error) {
+	config := &tls.Config{}
+	if len(t.ClientCAFile) == 0 {
+		return config, nil
 	}
-	defer dir.Close()
-	entries, err := dir.Readdir(0)
+	caBytes, err := os.ReadFile(t.ClientCAFile)
 	if err != nil {
 		return nil, err
 	}
-	groups := map[string]os.FileInfo{}
-	for _, entry := range entries {
-		groups[entry.Name()] = entry
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("No certificates found in %s", t.ClientCAFile)
 	}
-	return groups, nil
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.VerifyConnection = t.verifyClient
+	return config, nil
 }
 
-type FileTender struct {
-	Files                *FileManager
-	RetentionPeriod      time.Duration
-	RetentionCheckPeriod time.Duration
+type Server struct {
+	ListenAddr string
+	TLS        *TLSConfig
 }
 
-func (f *FileTender) RunRetentionCheck(now time.Time) []error {
-	groups, err := f.Files.ListGroups()
-	if err != nil {
-		return []error{err}
-	}
-	errs := []error{}
-	for group, info := range groups {
-		if now.Sub(info.ModTime()) > f.RetentionPeriod {
-			err = f.Files.Delete(group)
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
-	}
-	if len(errs) == 0 {
-		return nil
+func (s *Server) ListenAndServe(handler http.Handler) error {
+	if s.TLS == nil {
+		return http.ListenAndServe(s.ListenAddr, handler)
 	}
-	return errs
-}
-
-func (f *FileTender) Run(stop chan struct{}) {
-	ticker := time.NewTicker(f.RetentionCheckPeriod)
-	for {
-		select {
-		case tick := <-ticker.C:
-			f.RunRetentionCheck(tick)
-		case _ = <-stop:
-			return
-		}
+	tlsConfig, err := s.TLS.Config()
+	if err != nil {
+		return err
 	}
+	server := &http.Server{Addr: s.ListenAddr, Handler: handler, TLSConfig: tlsConfig}
+	return server.ListenAndServeTLS(s.TLS.CertFile, s.TLS.KeyFile)
 }
 
 const SubmitterEndpoint = "/task"
 
 type Submitter struct {
 	Server
-	ContextPath          string
-	Files                *FileManager
-	DruidIndexerEndpoint url.URL
-	FetchURLBase         url.URL
+	ContextPath string
+	Files       FileManager
+	Druid       *DruidClient
+	Metadata    *MetadataStore
+	InputSource InputSource
+	// RetentionPeriod is how long groups are kept, for reporting when they expire
+	RetentionPeriod time.Duration
+	// Auth, if set, requires requests to be authenticated, and only allows principals to access their own groups
+	Auth *Auth
+	// Policy, if set, decides which tasks each principal may submit
+	Policy *Policy
+	// Streams, if set, allows submissions to stream their file to Druid instead of storing it
+	Streams *StreamBroker
+	// Sources, if set, allows submissions to list URLs for the gateway to download instead of uploading files
+	Sources *RemoteSources
+	// Templates, if set, allows tasks to be submitted with a spec template and parameters instead of a spec
+	Templates *TemplateStore
+	// ZipSpool is where zip archives are written to expand them
+	ZipSpool ZipSpool
 }
 
 func (s *Submitter) Handle(mux *http.ServeMux) {
-	mux.HandleFunc(s.ContextPath+SubmitterEndpoint, s.Task)
-	mux.HandleFunc(s.ContextPath+SubmitterEndpoint+"/", s.Task)
+	mux.HandleFunc(s.ContextPath+SubmitterEndpoint, s.authenticated(s.Task))
+	mux.HandleFunc(s.ContextPath+SubmitterEndpoint+"/", s.authenticated(s.Task))
+	mux.HandleFunc(s.ContextPath+SQLSubmitterEndpoint, s.authenticated(s.SQLTask))
+	mux.HandleFunc(s.ContextPath+GroupsEndpoint, s.authenticated(s.Groups))
+	mux.HandleFunc(s.ContextPath+GroupsEndpoint+"/", s.authenticated(s.Groups))
+	mux.HandleFunc(s.ContextPath+TemplatesEndpoint, s.authenticated(s.SpecTemplates))
+	mux.HandleFunc(s.ContextPath+TemplatesEndpoint+"/", s.authenticated(s.SpecTemplates))
 	mux.HandleFunc(s.ContextPath+"/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 }
 
 func (s *Submitter) Task(w http.ResponseWriter, r *http.Request) {
+	if taskID, resource := s.taskResource(r); len(resource) != 0 {
+		s.Proxy(w, r, taskID, resource)
+		return
+	}
 	switch r.Method {
+	case "GET":
+		if len(strings.Trim(strings.TrimPrefix(r.URL.Path, s.ContextPath+SubmitterEndpoint), "/")) == 0 {
+			s.List(w, r)
+		} else {
+			s.Describe(w, r)
+		}
+		return
 	case "DELETE":
 		s.Cleanup(w, r)
 		return
@@ -177,7 +220,7 @@ func (s *Submitter) Task(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-const BadIndexTaskMethodMsg = "/task endpoint supports POST for submitting tasks, and /task/{group} supports DELETE for cleaning up file sets"
+const BadIndexTaskMethodMsg = "/task endpoint supports POST for submitting tasks and GET for listing file sets, /task/validate supports POST for checking submissions without submitting them, /task/{group} supports GET for listing files and DELETE for cleaning up file sets, and /task/{id}/{status,reports,log,shutdown} retrieves information about or stops submitted tasks"
 
 const BadIndexTaskMsg = "Task submissions must be a multi-part upload with the task spec as the first part, and all files to ingest as the remaining parts with filenames"
 
@@ -186,96 +229,394 @@ const BadIndexTaskSpecMsg = "Task spec must be an index or index_parallel type t
 const InternalErrorMsg = "Internal Error"
 
 func (s *Submitter) Index(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(*r)
+	// Only log who the request is from, as its headers may contain credentials
+	fmt.Printf("Task submission from %s (%s)\n", r.RemoteAddr, principalOf(r).Name)
 	multipart, err := r.MultipartReader()
 	if err != nil {
 		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
 		return
 	}
-	group := uuid.New().String()
-	part, err := multipart.NextPart()
+	taskSpec, spec, ioConfig, ok := s.submittedTaskSpec(w, r, func() (io.Reader, error) {
+		return multipart.NextPart()
+	})
+	if !ok {
+		return
+	}
+
+	stream := r.URL.Query().Get("stream") == "true"
+	if stream && s.Streams == nil {
+		ErrorResponse(w, http.StatusBadRequest, BadStreamMsg)
+		return
+	}
+	// The schema of streamed files cannot be inferred, as they can only be read once
+	if stream && (!streamable(taskSpec, spec) || r.URL.Query().Get("inferSchema") == "true") {
+		ErrorResponse(w, http.StatusBadRequest, BadStreamTaskSpecMsg)
+		return
+	}
+
+	policyRequest := NativePolicyRequest(taskSpec["type"].(string), spec)
+	if !s.checkPolicy(w, r, policyRequest) {
+		return
+	}
+	if s.isDryRun(r) {
+		s.DryRun(w, r, taskSpec, ioConfig, multipart)
+		return
+	}
+	if stream {
+		s.IndexStream(w, r, taskSpec, ioConfig, multipart, policyRequest.DataSource)
+		return
+	}
+	group, err := s.createGroup(r, policyRequest.DataSource)
 	if err != nil {
-		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	var successful bool
+	defer func() {
+		if !successful {
+			s.discardGroup(group)
+		}
+	}()
+	items, ok := s.receiveFiles(w, r, multipart, group)
+	if !ok {
 		return
 	}
-	taskSpec := map[string]interface{}{}
-	err = json.NewDecoder(part).Decode(&taskSpec)
+	successful = s.submitIndexTask(w, r, taskSpec, ioConfig, group, items)
+}
+
+// submittedTaskSpec returns the native task spec of a submission, filled in from a template if it names one, or read from nextSpec.
+// When inferring the schema, the spec may be partial, or with a dataSource parameter, not given at all, so that every part is a file.
+// If it is invalid, an error response has already been sent.
+func (s *Submitter) submittedTaskSpec(w http.ResponseWriter, r *http.Request, nextSpec func() (io.Reader, error)) (taskSpec, spec, ioConfig map[string]interface{}, ok bool) {
+	query := r.URL.Query()
+	inferSchema := query.Get("inferSchema") == "true"
+	switch {
+	case query.Has("template"):
+		// With a template, every part is a file to ingest
+		return s.templateTaskSpec(w, r)
+	case inferSchema && query.Has("dataSource"):
+		taskSpec = map[string]interface{}{}
+	default:
+		specReader, err := nextSpec()
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
+			return nil, nil, nil, false
+		}
+		taskSpec = map[string]interface{}{}
+		err = json.NewDecoder(specReader).Decode(&taskSpec)
+		if err != nil {
+			fmt.Println(err)
+			ErrorResponse(w, http.StatusBadRequest, BadIndexTaskSpecMsg)
+			return nil, nil, nil, false
+		}
+	}
+	if inferSchema {
+		completeTaskSpec(taskSpec, query.Get("dataSource"))
+	}
+	spec, ioConfig, ok = checkIndexTaskSpec(w, taskSpec)
+	return taskSpec, spec, ioConfig, ok
+}
+
+// parseIndexTaskSpec reads a native task spec, and returns it along with its spec and ioConfig.
+// If it is invalid, an error response has already been sent.
+func parseIndexTaskSpec(w http.ResponseWriter, r io.Reader) (taskSpec, spec, ioConfig map[string]interface{}, ok bool) {
+	taskSpec = map[string]interface{}{}
+	err := json.NewDecoder(r).Decode(&taskSpec)
 	if err != nil {
 		fmt.Println(err)
 		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskSpecMsg)
-		return
+		return nil, nil, nil, false
 	}
+	spec, ioConfig, ok = checkIndexTaskSpec(w, taskSpec)
+	return taskSpec, spec, ioConfig, ok
+}
+
+// checkIndexTaskSpec returns the spec and ioConfig of a native task spec, if it is one.
+// If it is not, an error response has already been sent.
+func checkIndexTaskSpec(w http.ResponseWriter, taskSpec map[string]interface{}) (spec, ioConfig map[string]interface{}, ok bool) {
 	fmt.Printf("%#v\n", taskSpec)
 
-	spec, ok := taskSpec["spec"].(map[string]interface{})
+	spec, ok = taskSpec["spec"].(map[string]interface{})
 	if !ok || (taskSpec["type"] != "index" && taskSpec["type"] != "index_parallel") {
 		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskSpecMsg)
-		return
+		return nil, nil, false
 	}
-	ioConfig, ok := spec["ioConfig"].(map[string]interface{})
+	ioConfig, ok = spec["ioConfig"].(map[string]interface{})
 	if !ok {
 		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskSpecMsg)
+		return nil, nil, false
+	}
+	return spec, ioConfig, true
+}
+
+// checkFiles infers the inputFormat of a native task spec from the files it ingests, or checks it against them,
+// and with inferSchema=true, infers its schema too
+func checkFiles(r *http.Request, taskSpec, ioConfig map[string]interface{}, group string, items []string, open func(item string) (io.ReadCloser, error)) error {
+	err := inferInputFormat(taskSpec, ioConfig, group, items, open)
+	if err == nil && r.URL.Query().Get("inferSchema") == "true" {
+		err = inferSchema(taskSpec, ioConfig, group, items, open)
+	}
+	return err
+}
+
+// submitIndexTask points a native task spec at the files in a group and submits it, and returns true if Druid accepted it
+func (s *Submitter) submitIndexTask(w http.ResponseWriter, r *http.Request, taskSpec, ioConfig map[string]interface{}, group string, items []string) bool {
+	err := checkFiles(r, taskSpec, ioConfig, group, items, func(item string) (io.ReadCloser, error) {
+		return s.Files.Get(group, item)
+	})
+	if err != nil {
+		filesCheckFailed(w, err)
+		return false
+	}
+	ioConfig["inputSource"], err = s.InputSource.InputSource(group, items)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+
+	taskSpecBytes, err := json.Marshal(taskSpec)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	redactedSpecBytes, err := redactedTaskSpec(taskSpec, ioConfig)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	fmt.Println(string(redactedSpecBytes))
+	taskResponse, err := s.Druid.SubmitTask(taskSpecBytes, r)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	return s.forwardTaskResponse(w, r, group, redactedSpecBytes, taskResponse)
+}
+
+// createGroup records a new group of files for a submission.
+// With keep=true, the files are kept until the retention period for more tasks to be submitted for them.
+func (s *Submitter) createGroup(r *http.Request, dataSource string) (string, error) {
+	group := uuid.New().String()
+	err := s.Metadata.Create(GroupRecord{
+		Group:      group,
+		Created:    time.Now(),
+		Client:     r.RemoteAddr,
+		Owner:      principalOf(r).Name,
+		DataSource: dataSource,
+		Files:      []FileRecord{},
+		Keep:       r.URL.Query().Get("keep") == "true",
+	})
+	return group, err
+}
+
+// discardGroup deletes a group whose submission failed
+func (s *Submitter) discardGroup(group string) {
+	err := s.Files.Delete(group)
+	if err != nil {
+		fmt.Println(err)
+		// Leave the record so that the retention check tries again
 		return
 	}
+	err = s.Metadata.Remove(group)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
 
-	uris := []string{}
-	var successful bool
-	defer func() {
-		if !successful {
-			s.Files.Delete(group)
+// receiveFiles stores all remaining parts of a submission in a group, expanding any archives and downloading any sources,
+// and returns their names. If this fails, an error response has already been sent.
+func (s *Submitter) receiveFiles(w http.ResponseWriter, r *http.Request, parts *multipart.Reader, group string) ([]string, bool) {
+	items := []string{}
+	var itemsLock sync.Mutex
+	// Sources are downloaded concurrently
+	store := func(filename string, file io.Reader) error {
+		contents := newChecksumReader(file)
+		err := s.Files.Put(group, filename, contents)
+		if err != nil {
+			return err
 		}
-	}()
-	for part, err = multipart.NextPart(); err == nil; part, err = multipart.NextPart() {
-		filename := strings.TrimPrefix(strings.TrimPrefix(part.FileName(), "/"), "./")
+		itemsLock.Lock()
+		items = append(items, filename)
+		itemsLock.Unlock()
+		return s.Metadata.Update(group, func(record *GroupRecord) {
+			record.Files = append(record.Files, contents.Record(filename))
+		})
+	}
+	if !s.receiveParts(w, r, parts, store) {
+		return nil, false
+	}
+	return items, true
+}
+
+// errDuplicateFile is returned when a submission has more than one file with the same name, which would be stored over each other
+type errDuplicateFile struct {
+	filename string
+}
+
+func (e errDuplicateFile) Error() string {
+	return fmt.Sprintf("%s was submitted more than once, each file must have a different name", e.filename)
+}
+
+// submittedNames tracks the names of the files in a submission, whether uploaded, expanded from an archive, or downloaded
+type submittedNames struct {
+	lock  sync.Mutex
+	names map[string]bool
+}
+
+// claim returns an errDuplicateFile if a file with the same name is already part of the submission
+func (n *submittedNames) claim(filename string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.names[filename] {
+		return errDuplicateFile{filename}
+	}
+	n.names[filename] = true
+	return nil
+}
+
+// receiveParts passes each file in the remaining parts of a submission to store, expanding archives and downloading sources.
+// If this fails, an error response has already been sent.
+func (s *Submitter) receiveParts(w http.ResponseWriter, r *http.Request, parts *multipart.Reader, store func(filename string, contents io.Reader) error) bool {
+	names := &submittedNames{names: map[string]bool{}}
+	storeUnique := func(filename string, contents io.Reader) error {
+		err := names.claim(filename)
+		if err != nil {
+			return err
+		}
+		return store(filename, contents)
+	}
+	var part *multipart.Part
+	var err error
+	for part, err = parts.NextPart(); err == nil; part, err = parts.NextPart() {
+		if len(part.FileName()) == 0 && part.FormName() == SourcesPartName {
+			if !s.downloadSources(w, r, part, names, store) {
+				return false
+			}
+			continue
+		}
+		filename, ok := submittedFilename(part.FileName())
 		fmt.Println(filename)
-		if len(filename) == 0 || MaliciousPath(filename) {
+		if !ok {
 			ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
-			return
+			return false
+		}
+		if kind := ArchiveKind(filename, part.Header.Get("Content-Type")); len(kind) != 0 {
+			err = ExpandArchive(kind, part, s.ZipSpool, storeUnique)
+		} else {
+			err = storeUnique(filename, part)
+		}
+		if _, ok := err.(errDuplicateFile); ok {
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		if _, ok := err.(errZipTooLarge); ok {
+			fmt.Printf("Bad archive %s: %s\n", filename, err)
+			ErrorResponse(w, http.StatusRequestEntityTooLarge, ZipTooLargeMsg)
+			return false
+		}
+		if _, ok := err.(errBadArchive); ok {
+			fmt.Printf("Bad archive %s: %s\n", filename, err)
+			ErrorResponse(w, http.StatusBadRequest, BadArchiveMsg)
+			return false
 		}
-		err = s.Files.Put(group, filename, part)
 		if err != nil {
 			fmt.Println(err)
 			ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
-			return
+			return false
 		}
-		fetchURL := s.FetchURLBase
-		fetchURL.Path += group + "/" + filename
-		uris = append(uris, fetchURL.String())
 	}
 	if err != nil && err != io.EOF {
 		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
-		return
+		return false
 	}
+	return true
+}
 
-	inputSource := map[string]interface{}{}
-	inputSource["type"] = "http"
-	inputSource["uris"] = uris
-	ioConfig["inputSource"] = inputSource
-	// TODO: Option for authentication if TLS is enabled both ways?
-
-	taskSpecBytes, err := json.Marshal(taskSpec)
-	if err != nil {
+// downloadSources downloads the files listed in the sources part of a submission, once it has checked that none of them
+// have the same name as another file in the submission. If this fails, an error response has already been sent.
+func (s *Submitter) downloadSources(w http.ResponseWriter, r *http.Request, part *multipart.Part, names *submittedNames, store func(filename string, contents io.Reader) error) bool {
+	if s.Sources == nil {
+		ErrorResponse(w, http.StatusBadRequest, BadSourcesMsg)
+		return false
+	}
+	sources, err := s.Sources.ParseRemoteSources(part)
+	for i := 0; err == nil && i < len(sources); i++ {
+		err = names.claim(sources[i].Filename)
+	}
+	if err == nil {
+		err = s.Sources.Download(r.Context(), sources, store)
+	}
+	if _, ok := err.(errDuplicateFile); ok {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if _, ok := err.(errBadSource); ok {
 		fmt.Println(err)
-		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
-		return
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return false
 	}
-	fmt.Println(string(taskSpecBytes))
-	taskResponse, err := http.Post(s.DruidIndexerEndpoint.String(), "application/json", bytes.NewReader(taskSpecBytes))
 	if err != nil {
 		fmt.Println(err)
 		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
-		return
+		return false
 	}
+	return true
+}
+
+// forwardTaskResponse relays Druid's response to a task submission, and returns true if Druid accepted the task
+func (s *Submitter) forwardTaskResponse(w http.ResponseWriter, r *http.Request, group string, spec []byte, taskResponse *http.Response) bool {
 	defer taskResponse.Body.Close()
-	if taskResponse.StatusCode == http.StatusOK {
-		successful = true
+	taskResponseBody, err := io.ReadAll(taskResponse.Body)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusBadGateway, InternalErrorMsg)
+		return false
 	}
-	for name, values := range taskResponse.Header {
-		w.Header()[name] = values
+	var successful bool
+	var taskID string
+	if taskResponse.StatusCode == http.StatusOK || taskResponse.StatusCode == http.StatusAccepted {
+		successful = true
+		taskID = s.trackTask(group, taskResponseBody)
 	}
-	w.WriteHeader(taskResponse.StatusCode)
-	io.Copy(w, taskResponse.Body)
+	s.writeTaskResponse(w, r, group, spec, taskID, taskResponse, taskResponseBody)
 	// Should probably log this if it fails
+	return successful
+}
+
+// trackTask records the task Druid created for a group, linking it to the group if it already has one, and returns its ID if it could be determined
+func (s *Submitter) trackTask(group string, taskResponseBody []byte) string {
+	// Native tasks return "task", SQL tasks return "taskId"
+	taskResponse := struct {
+		Task   string `json:"task"`
+		TaskID string `json:"taskId"`
+	}{}
+	err := json.Unmarshal(taskResponseBody, &taskResponse)
+	taskID := taskResponse.Task
+	if len(taskID) == 0 {
+		taskID = taskResponse.TaskID
+	}
+	if err != nil || len(taskID) == 0 {
+		fmt.Printf("Could not determine task ID for group %s from Druid response, files will be cleaned up after the retention period: %v\n", group, err)
+		return ""
+	}
+	err = s.Metadata.Update(group, func(record *GroupRecord) {
+		if len(record.TaskID) != 0 {
+			record.LinkedTasks = append(record.LinkedTasks, TaskRecord{TaskID: taskID, TaskStatus: TaskStatusRunning})
+			return
+		}
+		record.TaskID = taskID
+		record.TaskStatus = TaskStatusRunning
+	})
+	if err != nil {
+		// The retention check will still clean up the group eventually
+		fmt.Println(err)
+	}
+	return taskID
 }
 
 const BadFileMsg = "Unknown or Illegal Group or File"
@@ -283,25 +624,88 @@ const BadFileMsg = "Unknown or Illegal Group or File"
 func (s *Submitter) Cleanup(w http.ResponseWriter, r *http.Request) {
 	group := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, s.ContextPath+SubmitterEndpoint), "/")
 	// No subdirs or relative paths allowed, only single basenames
-	if strings.Contains(group, "/") || MaliciousPath(group) {
+	if strings.Contains(group, "/") || MaliciousPath(group) || HiddenGroup(group) {
 		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
 		return
 	}
+	if s.Auth != nil {
+		// Groups without a record have no owner, so only admins may delete them
+		record, _ := s.Metadata.Get(group)
+		if !s.Auth.CanAccess(principalOf(r), &record) {
+			ErrorResponse(w, http.StatusForbidden, NotOwnerMsg)
+			return
+		}
+	}
 	err := s.Files.Delete(group)
 	if err != nil {
 		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
 		return
 	}
+	err = s.Metadata.Update(group, func(record *GroupRecord) {
+		record.Deleted = time.Now()
+	})
+	if err != nil && err != ErrUnknownGroup {
+		fmt.Println(err)
+	}
 }
 
 const RetrieverEndpoint = "/file"
 
-const BadFetchMethodMsg = "/file endpoints only support GET"
+const BadFetchMethodMsg = "/file endpoints only support GET and HEAD"
+
+// ContentTypes maps the extensions of files commonly ingested by Druid to their content types.
+// Compressed files are served as-is, so they must never be given a Content-Encoding, or clients
+// would decompress them before Druid sees them.
+var ContentTypes = map[string]string{
+	".avro":    "application/avro",
+	".bz2":     "application/x-bzip2",
+	".csv":     "text/csv",
+	".gz":      "application/gzip",
+	".json":    "application/json",
+	".orc":     "application/x-orc",
+	".parquet": "application/vnd.apache.parquet",
+	".tsv":     "text/tab-separated-values",
+	".txt":     "text/plain",
+	".xz":      "application/x-xz",
+	".zip":     "application/zip",
+	".zst":     "application/zstd",
+}
+
+// ContentType returns the content type to serve a file with, based on its extension
+func ContentType(item string) string {
+	contentType, ok := ContentTypes[strings.ToLower(path.Ext(item))]
+	if !ok {
+		return "application/octet-stream"
+	}
+	return contentType
+}
 
 type Retriever struct {
 	Server
 	ContextPath string
-	Files       *FileManager
+	Files       FileManager
+	Metadata    *MetadataStore
+	// Signer, if set, requires each request to be signed by the Submitter
+	Signer *URLSigner
+	// Credentials, if set, requires each request to use the credentials given to Druid for the group
+	Credentials FetchCredentials
+	// Streams, if set, serves files which are being streamed from submissions
+	Streams *StreamBroker
+}
+
+// etag returns a strong ETag for a file from its recorded checksum, or a weak one from its size and
+// modification time if the checksum is unknown
+func (rt *Retriever) etag(group, item string, info os.FileInfo) string {
+	if rt.Metadata != nil {
+		if record, ok := rt.Metadata.Get(group); ok {
+			for _, file := range record.Files {
+				if file.Name == item && len(file.SHA256) != 0 {
+					return `"` + file.SHA256 + `"`
+				}
+			}
+		}
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano())
 }
 
 func (r *Retriever) Handle(mux *http.ServeMux) {
@@ -312,85 +716,384 @@ func (r *Retriever) Handle(mux *http.ServeMux) {
 }
 
 func (rt *Retriever) Fetch(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "HEAD" {
 		ErrorResponse(w, http.StatusMethodNotAllowed, BadFetchMethodMsg)
 		return
 	}
 	requestedItem := strings.TrimPrefix(r.URL.Path, rt.ContextPath+RetrieverEndpoint+"/")
+	if rt.Signer != nil {
+		parts := strings.SplitN(requestedItem, "/", 4)
+		if len(parts) != 4 || !rt.Signer.Verify(parts[0], parts[1], parts[2], parts[3], time.Now()) {
+			ErrorResponse(w, http.StatusForbidden, BadSignatureMsg)
+			return
+		}
+		requestedItem = parts[2] + "/" + parts[3]
+	}
 	parts := strings.SplitN(requestedItem, "/", 2)
+	if len(parts) != 2 {
+		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
+		return
+	}
 	group := parts[0]
 	item := parts[1]
-	if len(group) == 0 || MaliciousPath(group) || len(item) == 0 || MaliciousPath(item) {
+	if len(group) == 0 || MaliciousPath(group) || HiddenGroup(group) || len(item) == 0 || MaliciousPath(item) {
 		ErrorResponse(w, http.StatusNotFound, BadFileMsg)
 		return
 	}
+	if rt.Credentials != nil {
+		username, password, ok := r.BasicAuth()
+		if !ok || !rt.Credentials.Check(group, username, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="druid-index-gateway"`)
+			ErrorResponse(w, http.StatusUnauthorized, BadCredentialsMsg)
+			return
+		}
+	}
+	if rt.Streams != nil && rt.serveStream(w, r, group, item) {
+		return
+	}
 	itemContents, err := rt.Files.Get(group, item)
 	if err != nil {
-		if err == os.ErrNotExist {
+		if os.IsNotExist(err) {
 			ErrorResponse(w, http.StatusNotFound, BadFileMsg)
 			return
 		} else {
+			fmt.Println(err)
 			ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
 			return
 		}
 	}
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, itemContents)
-	// Should probably log this if it fails
+	defer itemContents.Close()
+	info, err := itemContents.Stat()
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType(item))
+	w.Header().Set("ETag", rt.etag(group, item, info))
+	// ServeContent handles HEAD, ranges, and conditional requests
+	http.ServeContent(w, r, item, info.ModTime(), itemContents)
 }
 
 type Combined struct {
 	Server
 	SubmitterContextPath string
 	RetrieverContextPath string
-	Files                *FileManager
-	DruidIndexerEndpoint url.URL // Should end with druid/indexer/v1/task
-	FetchURLBase         url.URL
+	Files                FileManager
+	Druid                *DruidClient
+	Metadata             *MetadataStore
+	InputSource          InputSource
+	RetentionPeriod      time.Duration
+	Auth                 *Auth
+	Policy               *Policy
+	Streams              *StreamBroker
+	Sources              *RemoteSources
+	Templates            *TemplateStore
+	ZipSpool             ZipSpool
 }
 
 func (c *Combined) Handle(mux *http.ServeMux) {
 	(&Submitter{
-		Server:               c.Server,
-		ContextPath:          c.SubmitterContextPath,
-		Files:                c.Files,
-		DruidIndexerEndpoint: c.DruidIndexerEndpoint,
-		FetchURLBase:         c.FetchURLBase,
+		Server:          c.Server,
+		ContextPath:     c.SubmitterContextPath,
+		Files:           c.Files,
+		Druid:           c.Druid,
+		Metadata:        c.Metadata,
+		InputSource:     c.InputSource,
+		RetentionPeriod: c.RetentionPeriod,
+		Auth:            c.Auth,
+		Policy:          c.Policy,
+		Streams:         c.Streams,
+		Sources:         c.Sources,
+		Templates:       c.Templates,
+		ZipSpool:        c.ZipSpool,
 	}).Handle(mux)
+	// Files are only fetched from the gateway if the input source points back to it
+	httpInputSource, ok := c.InputSource.(*HTTPInputSource)
+	if !ok {
+		return
+	}
 	(&Retriever{
 		Server:      c.Server,
 		ContextPath: c.RetrieverContextPath,
 		Files:       c.Files,
+		Metadata:    c.Metadata,
+		Signer:      httpInputSource.Signer,
+		Credentials: httpInputSource.Credentials,
+		Streams:     c.Streams,
 	}).Handle(mux)
 }
 
 var (
-	tasksAddr            = flag.String("tasks-addr", ":8080", "Listen address for task submissions and cleanup")
-	tasksContextPath     = flag.String("tasks-context-path", "/tasks", "URL Sub-path for task submissions and cleanup")
-	tasksTLSCertPath     = flag.String("tasks-tls-cert", "", "Path to TLS certificate for task submissions and cleanup")
-	tasksTLSKeyPath      = flag.String("tasks-tls-key", "", "Path to TLS key for task submissions and cleanup")
+	tasksAddr        = flag.String("tasks-addr", ":8080", "Listen address for task submissions and cleanup")
+	tasksContextPath = flag.String("tasks-context-path", "/tasks", "URL Sub-path for task submissions and cleanup")
+	tasksTLSCertPath = flag.String("tasks-tls-cert", "", "Path to TLS certificate for task submissions and cleanup")
+	tasksTLSKeyPath  = flag.String("tasks-tls-key", "", "Path to TLS key for task submissions and cleanup")
+	tasksTLSClientCA = flag.String("tasks-tls-client-ca", "", "Path to CA certificates to require and verify client certificates with for task submissions and cleanup")
+	tasksTLSSubjects = flag.StringArray("tasks-tls-allowed-subject", []string{}, "Client certificate subject (common name or distinguished name) to allow for task submissions and cleanup. May be a glob pattern, and may be repeated. If neither this nor --tasks-tls-allowed-san are set, any certificate signed by --tasks-tls-client-ca is allowed")
+	tasksTLSSANs     = flag.StringArray("tasks-tls-allowed-san", []string{}, "Client certificate subject alternative name (DNS name, email, IP, or URI) to allow for task submissions and cleanup. May be a glob pattern, and may be repeated")
+	authAPIKeysFile  = flag.String("auth-api-keys-file", "", "Path to a file of API keys to authenticate task submissions with, in the X-Api-Key header. Each line is a key, the principal it authenticates as, and optionally a comma-separated list of roles")
+	authHtpasswd     = flag.String("auth-htpasswd-file", "", "Path to an htpasswd file of users to authenticate task submissions with, using HTTP basic authentication. Passwords must be hashed with bcrypt or SHA-1")
+	authJWKSFile     = flag.String("auth-jwks-file", "", "Path to a JSON Web Key Set to verify bearer JWTs authenticating task submissions with. The subject of each token is the principal")
+	authJWTIssuer    = flag.String("auth-jwt-issuer", "", "If set, bearer JWTs must have this issuer")
+	authJWTAudience  = flag.String("auth-jwt-audience", "", "If set, bearer JWTs must have this audience")
+	authJWTRoles     = flag.String("auth-jwt-roles-claim", "roles", "Claim of bearer JWTs listing the roles of the principal")
+	authAdminRole    = flag.String("auth-admin-role", "admin", "Role which can access the files and tasks submitted by every principal")
+	authAdmins       = flag.StringArray("auth-admin", []string{}, "Principal which can access the files and tasks submitted by every principal. May be repeated")
+
+	policyFile = flag.String("policy-file", "", "Path to a JSON policy deciding which datasources and kinds of tasks each principal may submit. If not set, any task may be submitted")
+
 	druidIndexerEndpoint = flag.String("druid-indexer-endpoint", "http://localhost:8888/druid/indexer/v1/task", "URL to sent Druid tasks to")
+	druidSQLTaskEndpoint = flag.String("druid-sql-task-endpoint", "http://localhost:8888/druid/v2/sql/task", "URL to send Druid SQL-based ingestion tasks to")
+	druidUsername        = flag.String("druid-username", "", "Username to authenticate to Druid with, when it uses the druid-basic-security extension")
+	druidPassword        = flag.String("druid-password", "", "Password to authenticate to Druid with. Prefer setting this in --config rather than on the command line")
+	druidAuthPassthrough = flag.Bool("druid-auth-passthrough", false, "Send the Authorization header of each request to the gateway to Druid, instead of --druid-username and --druid-password. Requests the gateway makes on its own, such as checking task status, still use --druid-username and --druid-password")
+	druidCACert          = flag.String("druid-ca-cert", "", "Path to CA certificates to trust, in addition to the system CAs, when connecting to Druid over HTTPS")
+	druidTLSCert         = flag.String("druid-tls-cert", "", "Path to a client certificate to present when connecting to Druid over HTTPS")
+	druidTLSKey          = flag.String("druid-tls-key", "", "Path to the key of --druid-tls-cert")
 
 	filesAddr        = flag.String("files-addr", ":8080", "Listen address for retrieving submitted files")
 	filesContextPath = flag.String("files-context-path", "/files", "URL Sub-path for retrieving submitted files")
 	filesTLSCertPath = flag.String("files-tls-cert", "", "Path to TLS certificate for retrieving submitted files")
 	filesTLSKeyPath  = flag.String("files-tls-key", "", "Path to TLS key for retrieving submitted files")
+	filesTLSClientCA = flag.String("files-tls-client-ca", "", "Path to CA certificates to require and verify client certificates with for retrieving submitted files")
+	filesTLSSubjects = flag.StringArray("files-tls-allowed-subject", []string{}, "Client certificate subject (common name or distinguished name) to allow for retrieving submitted files. May be a glob pattern, and may be repeated. If neither this nor --files-tls-allowed-san are set, any certificate signed by --files-tls-client-ca is allowed")
+	filesTLSSANs     = flag.StringArray("files-tls-allowed-san", []string{}, "Client certificate subject alternative name (DNS name, email, IP, or URI) to allow for retrieving submitted files. May be a glob pattern, and may be repeated")
 	filesExternalURL = flag.String("files-external-url", "", "Root URL files will be accessible to Druid from. Defaults to http(s)://{files-addr}{files-context-path}/files/, depending on whether or not TLS certs are provided")
+	filesURLKeys     = flag.StringArray("files-url-key", []string{}, "Secret key to sign file URLs with, so that only tasks submitted by the gateway can fetch files. May be repeated, in which case the first key signs, and all keys are accepted, so that keys can be rotated")
+	filesURLKeysFile = flag.String("files-url-keys-file", "", "Path to a file of secret keys to sign file URLs with, one per line, accepted after any --files-url-key")
+	filesURLTTL      = flag.Duration("files-url-ttl", 0, "How long signed file URLs are valid for. Defaults to --retention-period")
+
+	filesAuth            = flag.String("files-auth", "none", "HTTP basic credentials Druid must fetch files with. One of none, group (a random password for each set of submitted files), or static (--files-auth-username and --files-auth-password)")
+	filesAuthUsername    = flag.String("files-auth-username", "druid", "Username Druid must fetch files with when --files-auth=static")
+	filesAuthPassword    = flag.String("files-auth-password", "", "Password Druid must fetch files with when --files-auth=static")
+	filesAuthPasswordEnv = flag.String("files-auth-password-env", "", "When --files-auth=static, read the password from this environment variable instead of --files-auth-password, and have Druid tasks read it from the same environment variable instead of including it in the task")
 
 	sharedTLSCertPath = flag.String("tls-cert", "", "Path to TLS certificate when listening on the same address for both tasks and files")
 	sharedTLSKeyPath  = flag.String("tls-key", "", "Path to TLS key when listening on the same address for both tasks and files")
+	sharedTLSClientCA = flag.String("tls-client-ca", "", "Path to CA certificates to require and verify client certificates with when listening on the same address for both tasks and files")
+	sharedTLSSubjects = flag.StringArray("tls-allowed-subject", []string{}, "Client certificate subject (common name or distinguished name) to allow when listening on the same address for both tasks and files. May be a glob pattern, and may be repeated")
+	sharedTLSSANs     = flag.StringArray("tls-allowed-san", []string{}, "Client certificate subject alternative name (DNS name, email, IP, or URI) to allow when listening on the same address for both tasks and files. May be a glob pattern, and may be repeated")
 
 	retentionPeriod      = flag.Duration("retention-period", time.Hour*1, "How long to retain submitted files before automatic deletion")
 	retentionCheckPeriod = flag.Duration("retention-check-period", time.Hour*1, "How frequently to check for submitted files which have passed the retention period")
 
-	rootDir = flag.String("root-dir", "/tmp/druid-index-gateway", "Root directory to store submitted files")
+	historyPeriod = flag.Duration("history-period", time.Hour*24, "How long to remember submitted files and tasks after the files are deleted, so that tasks can still be followed through the gateway")
+
+	taskStatusPollPeriod = flag.Duration("task-status-poll-period", time.Second*15, "How frequently to check Druid for the status of submitted tasks, and clean up the files of finished tasks. Set to 0 to disable, leaving cleanup to the retention period")
+
+	metadataFile = flag.String("metadata-file", "", "Path to the file recording each set of submitted files, and the task they were submitted with. Defaults to {root-dir}/.metadata.json")
+
+	configFile = flag.String("config", "", "Path to a JSON file of flag names to values, e.g. {\"druid-password\": \"...\"}. Flags given on the command line take precedence")
+
+	rootDir = flag.String("root-dir", "/tmp/druid-index-gateway", "Root directory to store submitted files and gateway state")
+
+	storage     = flag.String("storage", "local", "Where to store submitted files. One of local (under --root-dir) or s3 (in --s3-bucket)")
+	s3Endpoint  = flag.String("s3-endpoint", "https://s3.amazonaws.com", "URL of the S3-compatible object store when --storage=s3. Credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables")
+	s3Region    = flag.String("s3-region", "us-east-1", "Region of the S3-compatible object store when --storage=s3")
+	s3Bucket    = flag.String("s3-bucket", "", "Bucket to store submitted files in when --storage=s3")
+	s3Prefix    = flag.String("s3-prefix", "", "Prefix of object keys to store submitted files under when --storage=s3")
+	s3PathStyle = flag.Bool("s3-path-style", false, "Use path-style ({endpoint}/{bucket}) instead of virtual-hosted-style ({bucket}.{endpoint}) addressing when --storage=s3. Most self-hosted object stores require this")
+	s3PartSize  = flag.Int("s3-part-size", 16*1024*1024, "Size in bytes of the parts files are uploaded in when --storage=s3. Each concurrent upload buffers one part in memory")
+
+	inputSourceType       = flag.String("input-source", "http", "How Druid reads submitted files. One of http (fetch them from this gateway) or s3 (read them directly from --s3-bucket, requires --storage=s3 and the druid-s3-extensions extension)")
+	s3InputSourcePrefixes = flag.Bool("s3-input-source-prefixes", false, "When --input-source=s3, list the prefix of each set of submitted files instead of each file")
+	s3InputSourceEndpoint = flag.Bool("s3-input-source-endpoint", false, "When --input-source=s3, include --s3-endpoint, --s3-region, and --s3-path-style in the input source instead of relying on the Druid cluster's S3 configuration. Requires Druid 0.23 or later")
+
+	streaming     = flag.Bool("streaming", false, "Allow index tasks submitted with ?stream=true to stream their file to Druid as it is uploaded, instead of storing it first. Requires --input-source=http")
+	streamTimeout = flag.Duration("stream-timeout", time.Minute*5, "How long a streamed submission waits for Druid to start reading its file before shutting the task down")
+
+	sourcesAllowedHosts = flag.StringArray("sources-allowed-host", []string{}, "Host name, or host name and port, which submissions may have the gateway download files from, instead of uploading them. May be a glob pattern, and may be repeated. If not set, the gateway does not download files")
+	sourcesMaxSize      = flag.Int64("sources-max-size", 1024*1024*1024, "Largest file in bytes the gateway will download for a submission. Set to 0 for no limit")
+	sourcesConcurrency  = flag.Int("sources-concurrency", 4, "How many files the gateway downloads at once, across all submissions")
+	sourcesTimeout      = flag.Duration("sources-timeout", time.Minute*10, "How long the gateway may spend downloading each file for a submission")
+
+	zipSpoolDir     = flag.String("zip-spool-dir", "", "Local directory to write uploaded zip archives to before expanding them, as they cannot be read as they are uploaded. Defaults to the system temporary directory")
+	zipSpoolMaxSize = flag.Int64("zip-spool-max-size", 1024*1024*1024, "Largest zip archive in bytes the gateway will write to --zip-spool-dir to expand. Set to 0 for no limit")
+
+	templatesDir = flag.String("templates-dir", "", "Directory of spec templates, {name}.json, which tasks may be submitted with instead of a spec, e.g. ?template={name}&dataSource=... Templates may also be managed with PUT and DELETE {tasks-context-path}/templates/{name}. If not set, templates are disabled")
 )
 
 func main() {
 	flag.Parse()
+	if len(*configFile) != 0 {
+		err := LoadConfigFile(flag.CommandLine, *configFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 
 	stopChan := make(chan struct{})
 
-	fileManager := FileManager{RootDir: *rootDir}
+	var fileManager FileManager
+	switch *storage {
+	case "local":
+		fileManager = &LocalFileManager{RootDir: *rootDir}
+	case "s3":
+		s3EndpointURL, err := url.Parse(*s3Endpoint)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(*s3Bucket) == 0 {
+			fmt.Println("--s3-bucket is required when --storage=s3")
+			return
+		}
+		if *s3PartSize < S3MinPartSize {
+			fmt.Printf("--s3-part-size must be at least %d\n", S3MinPartSize)
+			return
+		}
+		prefix := *s3Prefix
+		if len(prefix) != 0 && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		fileManager = &S3FileManager{
+			Endpoint:        *s3EndpointURL,
+			Bucket:          *s3Bucket,
+			Prefix:          prefix,
+			Region:          *s3Region,
+			PathStyle:       *s3PathStyle,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			PartSize:        *s3PartSize,
+		}
+	default:
+		fmt.Println("--storage must be one of local or s3")
+		return
+	}
+	err := fileManager.Init()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var s3InputSource *S3InputSource
+	switch *inputSourceType {
+	case "http":
+	case "s3":
+		s3FileManager, ok := fileManager.(*S3FileManager)
+		if !ok {
+			fmt.Println("--input-source=s3 requires --storage=s3")
+			return
+		}
+		s3InputSource = &S3InputSource{
+			Files:           s3FileManager,
+			UsePrefixes:     *s3InputSourcePrefixes,
+			IncludeEndpoint: *s3InputSourceEndpoint,
+		}
+	default:
+		fmt.Println("--input-source must be one of http or s3")
+		return
+	}
+	auth := &Auth{AdminRole: *authAdminRole, Admins: *authAdmins}
+	if len(*authAPIKeysFile) != 0 {
+		apiKeys, err := LoadAPIKeys(*authAPIKeysFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		auth.Authenticators = append(auth.Authenticators, apiKeys)
+	}
+	if len(*authHtpasswd) != 0 {
+		htpasswd, err := LoadHtpasswd(*authHtpasswd)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		auth.Authenticators = append(auth.Authenticators, htpasswd)
+	}
+	if len(*authJWKSFile) != 0 {
+		keys, err := LoadJWKS(*authJWKSFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		auth.Authenticators = append(auth.Authenticators, &JWTAuthenticator{
+			Keys:       keys,
+			Issuer:     *authJWTIssuer,
+			Audience:   *authJWTAudience,
+			RolesClaim: *authJWTRoles,
+		})
+	}
+	if len(auth.Authenticators) == 0 {
+		auth = nil
+	}
+	var policy *Policy
+	if len(*policyFile) != 0 {
+		policy, err = LoadPolicy(*policyFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	var streams *StreamBroker
+	if *streaming {
+		if s3InputSource != nil {
+			fmt.Println("--streaming requires --input-source=http")
+			return
+		}
+		streams = &StreamBroker{Timeout: *streamTimeout}
+	}
+	var sources *RemoteSources
+	if len(*sourcesAllowedHosts) != 0 {
+		sources, err = NewRemoteSources(*sourcesAllowedHosts, *sourcesMaxSize, *sourcesConcurrency, *sourcesTimeout)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	zipSpool := ZipSpool{Dir: *zipSpoolDir, MaxSize: *zipSpoolMaxSize}
+	var templates *TemplateStore
+	if len(*templatesDir) != 0 {
+		templates, err = LoadTemplates(*templatesDir)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	var signer *URLSigner
+	signingKeys := [][]byte{}
+	for _, key := range *filesURLKeys {
+		signingKeys = append(signingKeys, []byte(key))
+	}
+	if len(*filesURLKeysFile) != 0 {
+		fileKeys, err := ReadURLSigningKeys(*filesURLKeysFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		signingKeys = append(signingKeys, fileKeys...)
+	}
+	if len(signingKeys) != 0 {
+		signer = &URLSigner{Keys: signingKeys, TTL: *filesURLTTL}
+		if signer.TTL == 0 {
+			signer.TTL = *retentionPeriod
+		}
+	}
+	var credentials FetchCredentials
+	switch *filesAuth {
+	case "none":
+	case "group":
+		// Set once the metadata store is loaded
+	case "static":
+		staticCredentials := &StaticCredentials{
+			Username:    *filesAuthUsername,
+			Password:    *filesAuthPassword,
+			PasswordEnv: *filesAuthPasswordEnv,
+		}
+		if len(staticCredentials.PasswordEnv) != 0 {
+			staticCredentials.Password = os.Getenv(staticCredentials.PasswordEnv)
+		}
+		if len(staticCredentials.Password) == 0 {
+			fmt.Println("--files-auth=static requires --files-auth-password or --files-auth-password-env")
+			return
+		}
+		credentials = staticCredentials
+	default:
+		fmt.Println("--files-auth must be one of none, group, or static")
+		return
+	}
 	filesExternalURLStr := *filesExternalURL
 	var needProtocolPrefix bool
 	if len(filesExternalURLStr) == 0 {
@@ -402,12 +1105,51 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	druidSQLTaskURL, err := url.Parse(*druidSQLTaskEndpoint)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	druidHTTPClient, err := NewDruidHTTPClient(*druidCACert, *druidTLSCert, *druidTLSKey)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	druid := DruidClient{
+		IndexerEndpoint: *druidIndexerURL,
+		SQLTaskEndpoint: *druidSQLTaskURL,
+		Client:          druidHTTPClient,
+		Username:        *druidUsername,
+		Password:        *druidPassword,
+		PassthroughAuth: *druidAuthPassthrough,
+	}
+	metadataPath := *metadataFile
+	if len(metadataPath) == 0 {
+		metadataPath = path.Join(*rootDir, ".metadata.json")
+	}
+	metadata := MetadataStore{Path: metadataPath}
+	err = metadata.Init()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *filesAuth == "group" {
+		credentials = &GroupCredentials{Metadata: &metadata}
+	}
+	if *taskStatusPollPeriod > 0 {
+		go (&TaskTracker{
+			Files:      fileManager,
+			Metadata:   &metadata,
+			Druid:      &druid,
+			PollPeriod: *taskStatusPollPeriod,
+		}).Run(stopChan)
+	}
 	if *tasksAddr == *filesAddr {
 		if strings.HasPrefix(*filesContextPath, *tasksContextPath) || strings.HasPrefix(*tasksContextPath, *filesContextPath) {
 			fmt.Println("--files-context-path and --tasks-context-path must not overlap when running on the same interface and port")
 			return
 		}
-		tlsConfig, err := ParseTLSConfig(*sharedTLSCertPath, *sharedTLSKeyPath)
+		tlsConfig, err := ParseTLSConfig(*sharedTLSCertPath, *sharedTLSKeyPath, *sharedTLSClientCA, *sharedTLSSubjects, *sharedTLSSANs)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -423,6 +1165,10 @@ func main() {
 			fmt.Println(err)
 			return
 		}
+		var inputSource InputSource = &HTTPInputSource{FetchURLBase: *filesExternalURLParsed, Signer: signer, Credentials: credentials}
+		if s3InputSource != nil {
+			inputSource = s3InputSource
+		}
 		combined := Combined{
 			Server: Server{
 				ListenAddr: *tasksAddr,
@@ -430,9 +1176,17 @@ func main() {
 			},
 			SubmitterContextPath: *tasksContextPath,
 			RetrieverContextPath: *filesContextPath,
-			Files:                &fileManager,
-			DruidIndexerEndpoint: *druidIndexerURL,
-			FetchURLBase:         *filesExternalURLParsed,
+			Files:                fileManager,
+			Druid:                &druid,
+			Metadata:             &metadata,
+			InputSource:          inputSource,
+			RetentionPeriod:      *retentionPeriod,
+			Auth:                 auth,
+			Policy:               policy,
+			Streams:              streams,
+			Sources:              sources,
+			Templates:            templates,
+			ZipSpool:             zipSpool,
 		}
 		mux := http.NewServeMux()
 		combined.Handle(mux)
@@ -442,12 +1196,12 @@ func main() {
 			close(stopChan)
 		}()
 	} else {
-		filesTLSConfig, err := ParseTLSConfig(*filesTLSCertPath, *filesTLSKeyPath)
+		filesTLSConfig, err := ParseTLSConfig(*filesTLSCertPath, *filesTLSKeyPath, *filesTLSClientCA, *filesTLSSubjects, *filesTLSSANs)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		tasksTLSConfig, err := ParseTLSConfig(*tasksTLSCertPath, *tasksTLSKeyPath)
+		tasksTLSConfig, err := ParseTLSConfig(*tasksTLSCertPath, *tasksTLSKeyPath, *tasksTLSClientCA, *tasksTLSSubjects, *tasksTLSSANs)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -463,33 +1217,52 @@ func main() {
 			fmt.Println(err)
 			return
 		}
-		retrieverMux := http.NewServeMux()
-		retriever := Retriever{
-			Server: Server{
-				ListenAddr: *filesAddr,
-				TLS:        filesTLSConfig,
-			},
-			ContextPath: *filesContextPath,
-			Files:       &fileManager,
+		var inputSource InputSource = &HTTPInputSource{FetchURLBase: *filesExternalURLParsed, Signer: signer, Credentials: credentials}
+		if s3InputSource != nil {
+			inputSource = s3InputSource
 		}
-		retriever.Handle(retrieverMux)
 		submitterMux := http.NewServeMux()
 		submitter := Submitter{
 			Server: Server{
 				ListenAddr: *tasksAddr,
 				TLS:        tasksTLSConfig,
 			},
-			ContextPath:          *tasksContextPath,
-			Files:                &fileManager,
-			DruidIndexerEndpoint: *druidIndexerURL,
-			FetchURLBase:         *filesExternalURLParsed,
+			ContextPath:     *tasksContextPath,
+			Files:           fileManager,
+			Druid:           &druid,
+			Metadata:        &metadata,
+			InputSource:     inputSource,
+			RetentionPeriod: *retentionPeriod,
+			Auth:            auth,
+			Policy:          policy,
+			Streams:         streams,
+			Sources:         sources,
+			Templates:       templates,
+			ZipSpool:        zipSpool,
 		}
 		submitter.Handle(submitterMux)
-		fmt.Printf("Listening on %s\n", *filesAddr)
-		go func() {
-			fmt.Println(retriever.ListenAndServe(retrieverMux))
-			close(stopChan)
-		}()
+		// Files are only fetched from the gateway if the input source points back to it
+		if s3InputSource == nil {
+			retrieverMux := http.NewServeMux()
+			retriever := Retriever{
+				Server: Server{
+					ListenAddr: *filesAddr,
+					TLS:        filesTLSConfig,
+				},
+				ContextPath: *filesContextPath,
+				Files:       fileManager,
+				Metadata:    &metadata,
+				Signer:      signer,
+				Credentials: credentials,
+				Streams:     streams,
+			}
+			retriever.Handle(retrieverMux)
+			fmt.Printf("Listening on %s\n", *filesAddr)
+			go func() {
+				fmt.Println(retriever.ListenAndServe(retrieverMux))
+				close(stopChan)
+			}()
+		}
 		fmt.Printf("Listening on %s\n", *tasksAddr)
 		go func() {
 			fmt.Println(submitter.ListenAndServe(submitterMux))
@@ -498,8 +1271,10 @@ func main() {
 	}
 
 	(&FileTender{
-		Files:                &fileManager,
+		Files:                fileManager,
+		Metadata:             &metadata,
 		RetentionPeriod:      *retentionPeriod,
+		HistoryPeriod:        *historyPeriod,
 		RetentionCheckPeriod: *retentionCheckPeriod,
 	}).Run(stopChan)
 }
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileRecord describes a submitted file
+type FileRecord struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// UploadRecord describes a file being uploaded to a pending group
+type UploadRecord struct {
+	// SHA256 is only known for files uploaded whole
+	FileRecord
+	// Length is the size the file will have once it is uploaded, if the client declared it
+	Length *int64 `json:"length,omitempty"`
+	// Complete is true once the whole file has been received
+	Complete bool `json:"complete"`
+}
+
+// TaskRecord describes a task submitted for a group of files
+type TaskRecord struct {
+	TaskID     string `json:"taskId"`
+	TaskStatus string `json:"taskStatus,omitempty"`
+}
+
+// Pending returns true if a task has been submitted, but has not been seen to finish
+func (t TaskRecord) Pending() bool {
+	return len(t.TaskID) != 0 && !TaskStatusFinished(t.TaskStatus) && t.TaskStatus != TaskStatusUnknown
+}
+
+// GroupRecord describes a group of submitted files, and the task they were submitted with
+type GroupRecord struct {
+	Group   string    `json:"group"`
+	Created time.Time `json:"created"`
+	Client  string    `json:"client"`
+	// Owner is the principal which submitted this group, if authentication is enabled
+	Owner      string       `json:"owner,omitempty"`
+	DataSource string       `json:"dataSource,omitempty"`
+	Files      []FileRecord `json:"files"`
+	TaskID     string       `json:"taskId,omitempty"`
+	TaskStatus string       `json:"taskStatus,omitempty"`
+	// LinkedTasks are the tasks submitted for this group's files after the first
+	LinkedTasks []TaskRecord `json:"linkedTasks,omitempty"`
+	// Keep is true if this group's files are kept for more tasks until the retention period, instead of being deleted once its tasks finish
+	Keep bool `json:"keep,omitempty"`
+	// FetchPasswordHash is the hash of the password Druid was given to fetch this group's files with, if any
+	FetchPasswordHash string `json:"fetchPasswordHash,omitempty"`
+	// LinkedFetchPasswordHashes are the hashes of the passwords given to the tasks linked to this group, which are also accepted
+	LinkedFetchPasswordHashes []string `json:"linkedFetchPasswordHashes,omitempty"`
+	// Pending is true while files are being uploaded to this group, before its task has been submitted
+	Pending bool `json:"pending,omitempty"`
+	// Uploads are the files uploaded to this group so far, while it is pending
+	Uploads []UploadRecord `json:"uploads,omitempty"`
+	// LastUpload is when a file was last uploaded to this group, while it was pending, which the retention period counts from instead
+	LastUpload time.Time `json:"lastUpload,omitempty"`
+	// Streamed is true if this group's file was streamed to Druid instead of stored, so it can only be read once
+	Streamed bool `json:"streamed,omitempty"`
+	// Deleted is when the files in this group were deleted, or zero if they still exist
+	Deleted time.Time `json:"deleted"`
+
+	// submitting is the number of tasks being linked to this group, which keep it from being deleted.
+	// It is not saved, as the submissions do not survive a restart.
+	submitting int
+	// uploading is the number of files being uploaded to this group, which also keep it from being deleted
+	uploading int
+}
+
+// LastActive returns when a group was last changed, which the retention period counts from
+func (g *GroupRecord) LastActive() time.Time {
+	if g.LastUpload.After(g.Created) {
+		return g.LastUpload
+	}
+	return g.Created
+}
+
+// Tasks returns every task submitted for a group's files, first to last
+func (g *GroupRecord) Tasks() []TaskRecord {
+	tasks := []TaskRecord{}
+	if len(g.TaskID) != 0 {
+		tasks = append(tasks, TaskRecord{TaskID: g.TaskID, TaskStatus: g.TaskStatus})
+	}
+	return append(tasks, g.LinkedTasks...)
+}
+
+// TaskPending returns true if any of a group's tasks have been submitted, but have not been seen to finish
+func (g *GroupRecord) TaskPending() bool {
+	for _, task := range g.Tasks() {
+		if task.Pending() {
+			return true
+		}
+	}
+	return false
+}
+
+// setTaskStatus records the status of one of a group's tasks
+func (g *GroupRecord) setTaskStatus(taskID, status string) {
+	if g.TaskID == taskID {
+		g.TaskStatus = status
+	}
+	for i := range g.LinkedTasks {
+		if g.LinkedTasks[i].TaskID == taskID {
+			g.LinkedTasks[i].TaskStatus = status
+		}
+	}
+}
+
+// Succeeded returns true if a group's files can be deleted as soon as its task finishes, because it was its only task, it succeeded,
+// and its files are not being kept for more. Groups whose task failed, or with tasks linked to them, are left for the retention check,
+// so that tasks can be re-run or linked to them until the retention period has passed.
+func (g *GroupRecord) Succeeded() bool {
+	if g.Keep || g.submitting != 0 || len(g.LinkedTasks) != 0 || !g.Deleted.IsZero() {
+		return false
+	}
+	return len(g.TaskID) != 0 && g.TaskStatus == TaskStatusSuccess
+}
+
+// Expirable returns true if a group may be deleted once it passes the retention period.
+// Groups are not deleted while files are being uploaded to them.
+// Groups kept for more tasks, or with tasks linked to them, are not deleted until all of their tasks have finished.
+func (g *GroupRecord) Expirable() bool {
+	return g.submitting == 0 && g.uploading == 0 && !((g.Keep || len(g.LinkedTasks) != 0) && g.TaskPending())
+}
+
+func (g *GroupRecord) copy() GroupRecord {
+	copied := *g
+	copied.Files = append([]FileRecord{}, g.Files...)
+	copied.Uploads = append([]UploadRecord(nil), g.Uploads...)
+	copied.LinkedTasks = append([]TaskRecord(nil), g.LinkedTasks...)
+	copied.LinkedFetchPasswordHashes = append([]string(nil), g.LinkedFetchPasswordHashes...)
+	return copied
+}
+
+var ErrUnknownGroup = fmt.Errorf("Unknown group")
+
+// metadataCompactionSlack is how many more lines than twice the number of groups the metadata log may hold before it is compacted,
+// so that a store with few groups is not compacted every few changes
+const metadataCompactionSlack = 1000
+
+// MetadataStore records what is known about each group of files in a log file, which has a line of JSON with the whole record
+// of a group after each change to it, so that a change does not rewrite every other group's. Once the log has grown to twice
+// as many lines as there are groups, plus metadataCompactionSlack, it is compacted to a line for each group.
+type MetadataStore struct {
+	Path string
+
+	lock   sync.Mutex
+	groups map[string]*GroupRecord
+	log    *os.File
+	// logEntries is how many lines are in the log
+	logEntries int
+}
+
+// metadataLogEntry is a line of the metadata log, with the record of a group after a change, or no record if it was removed
+type metadataLogEntry struct {
+	Group  string       `json:"group"`
+	Record *GroupRecord `json:"record,omitempty"`
+}
+
+func (m *MetadataStore) Init() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.groups = map[string]*GroupRecord{}
+	m.log = nil
+	f, err := os.Open(m.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	for {
+		line := json.RawMessage{}
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The last change may have been cut off by a crash
+			fmt.Printf("Ignoring the end of %s, which could not be read: %s\n", m.Path, err)
+			break
+		}
+		entry := metadataLogEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil || len(entry.Group) == 0 {
+			// Stores from before the log were a single object of every group
+			err = json.Unmarshal(line, &m.groups)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.Record == nil {
+			delete(m.groups, entry.Group)
+		} else {
+			m.groups[entry.Group] = entry.Record
+		}
+	}
+	return m.compact()
+}
+
+// compact rewrites the log with a line for each group, and must be called while holding the lock
+func (m *MetadataStore) compact() error {
+	if m.log != nil {
+		m.log.Close()
+		m.log = nil
+	}
+	err := os.MkdirAll(filepath.Dir(m.Path), 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename so that a crash never leaves a half-written store
+	tmpPath := m.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for group, record := range m.groups {
+		err = encoder.Encode(metadataLogEntry{Group: group, Record: record})
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, m.Path)
+	if err != nil {
+		return err
+	}
+	m.log, err = os.OpenFile(m.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	m.logEntries = len(m.groups)
+	return err
+}
+
+// save records the change to a group in the log, and must be called while holding the lock
+func (m *MetadataStore) save(group string) error {
+	if m.log == nil || m.logEntries >= 2*len(m.groups)+metadataCompactionSlack {
+		return m.compact()
+	}
+	line, err := json.Marshal(metadataLogEntry{Group: group, Record: m.groups[group]})
+	if err != nil {
+		return err
+	}
+	_, err = m.log.Write(append(line, '\n'))
+	if err != nil {
+		// The line may have been partly written, so start a new log instead of appending after it
+		m.log.Close()
+		m.log = nil
+		return err
+	}
+	m.logEntries++
+	return nil
+}
+
+func (m *MetadataStore) Create(record GroupRecord) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.groups[record.Group]; ok {
+		return fmt.Errorf("Group %s already exists", record.Group)
+	}
+	copied := record.copy()
+	m.groups[record.Group] = &copied
+	return m.save(record.Group)
+}
+
+// Update changes the record for a group
+func (m *MetadataStore) Update(group string, update func(*GroupRecord)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	record, ok := m.groups[group]
+	if !ok {
+		return ErrUnknownGroup
+	}
+	update(record)
+	return m.save(group)
+}
+
+func (m *MetadataStore) Get(group string) (GroupRecord, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	record, ok := m.groups[group]
+	if !ok {
+		return GroupRecord{}, false
+	}
+	return record.copy(), true
+}
+
+// FindTask returns the group which was submitted with a task
+func (m *MetadataStore) FindTask(taskID string) (GroupRecord, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, record := range m.groups {
+		for _, task := range record.Tasks() {
+			if task.TaskID == taskID {
+				return record.copy(), true
+			}
+		}
+	}
+	return GroupRecord{}, false
+}
+
+// List returns all groups, oldest first
+func (m *MetadataStore) List() []GroupRecord {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	records := make([]GroupRecord, 0, len(m.groups))
+	for _, record := range m.groups {
+		records = append(records, record.copy())
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Created.Equal(records[j].Created) {
+			return records[i].Group < records[j].Group
+		}
+		return records[i].Created.Before(records[j].Created)
+	})
+	return records
+}
+
+// MarkDeleted records that a group's files are being deleted if deletable returns true for it, and returns whether it did,
+// so that no more tasks can be submitted for them. Groups without a record, e.g. from before the metadata store, may always be deleted.
+func (m *MetadataStore) MarkDeleted(group string, now time.Time, deletable func(*GroupRecord) bool) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	record, ok := m.groups[group]
+	if !ok {
+		return true, nil
+	}
+	if !deletable(record) {
+		return false, nil
+	}
+	record.Deleted = now
+	return true, m.save(group)
+}
+
+// Remove forgets a group entirely, e.g. because it was never submitted
+func (m *MetadataStore) Remove(group string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.groups, group)
+	return m.save(group)
+}
+
+// Prune forgets groups whose files were deleted more than historyPeriod ago
+func (m *MetadataStore) Prune(now time.Time, historyPeriod time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for group, record := range m.groups {
+		if !record.Deleted.IsZero() && now.Sub(record.Deleted) > historyPeriod {
+			delete(m.groups, group)
+			err := m.save(group)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksumReader computes the size and checksum of everything read through it
+type checksumReader struct {
+	io.Reader
+	size int64
+	hash hash.Hash
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	c := &checksumReader{hash: sha256.New()}
+	c.Reader = io.TeeReader(r, c.hash)
+	return c
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.size += int64(n)
+	return n, err
+}
+
+func (c *checksumReader) Record(name string) FileRecord {
+	return FileRecord{Name: name, Size: c.size, SHA256: hex.EncodeToString(c.hash.Sum(nil))}
+}
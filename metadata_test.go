@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataRecordsSubmission(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	contents := `{"a": 1}`
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": contents})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	// Everything must be recovered after a restart
+	restarted := &MetadataStore{Path: submitter.Metadata.Path}
+	err := restarted.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := restarted.List()
+	if len(records) != 1 {
+		t.Fatalf("Expected one group, got %v", records)
+	}
+	record := records[0]
+	if record.Created.IsZero() || len(record.Client) == 0 || record.DataSource != "test" {
+		t.Fatalf("Submission not recorded: %#v", record)
+	}
+	if record.TaskID != "task-a" || record.TaskStatus != TaskStatusRunning {
+		t.Fatalf("Task not recorded: %#v", record)
+	}
+	sum := sha256.Sum256([]byte(contents))
+	expected := FileRecord{Name: "data.json", Size: int64(len(contents)), SHA256: hex.EncodeToString(sum[:])}
+	if len(record.Files) != 1 || record.Files[0] != expected {
+		t.Fatalf("Expected files %v, got %v", []FileRecord{expected}, record.Files)
+	}
+}
+
+func TestMetadataRemovesFailedSubmission(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	specPart, _ := writer.CreateFormField("spec.json")
+	specPart.Write([]byte(testIndexSpec))
+	filePart, _ := writer.CreateFormFile("file", "data.json")
+	filePart.Write([]byte("{}"))
+	// Files must have names
+	unnamedPart, _ := writer.CreateFormField("file")
+	unnamedPart.Write([]byte("{}"))
+	writer.Close()
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	req, _ := http.NewRequest("POST", "/tasks/task", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", resp.Code)
+	}
+	if records := submitter.Metadata.List(); len(records) != 0 {
+		t.Fatalf("Failed submission was recorded: %v", records)
+	}
+	if groups, _ := submitter.Files.ListGroups(); len(groups) != 0 {
+		t.Fatalf("Failed submission was not cleaned up: %v", groups)
+	}
+}
+
+func TestRetentionCheckUsesMetadata(t *testing.T) {
+	submitter, _ := newTestGateway(t)
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	tender := &FileTender{
+		Files:           submitter.Files,
+		Metadata:        submitter.Metadata,
+		RetentionPeriod: time.Hour,
+		HistoryPeriod:   time.Hour,
+	}
+	group := submitter.Metadata.List()[0].Group
+
+	now := time.Now()
+	if errs := tender.RunRetentionCheck(now); errs != nil {
+		t.Fatal(errs)
+	}
+	if _, err := submitter.Files.Stat(group, "data.json"); err != nil {
+		t.Fatalf("Group deleted before retention period: %v", err)
+	}
+
+	// The files were just written, so only the metadata knows they are old
+	submitter.Metadata.Update(group, func(record *GroupRecord) {
+		record.Created = now.Add(-2 * time.Hour)
+	})
+	if errs := tender.RunRetentionCheck(now); errs != nil {
+		t.Fatal(errs)
+	}
+	if _, err := submitter.Files.Stat(group, "data.json"); err == nil {
+		t.Fatalf("Group not deleted after retention period")
+	}
+	record, ok := submitter.Metadata.Get(group)
+	if !ok || !record.Deleted.Equal(now) {
+		t.Fatalf("Deletion not recorded: %v", record)
+	}
+
+	if errs := tender.RunRetentionCheck(now.Add(2 * time.Hour)); errs != nil {
+		t.Fatal(errs)
+	}
+	if _, ok := submitter.Metadata.Get(group); ok {
+		t.Fatalf("Group not forgotten after history period")
+	}
+}
+
+func TestMetadataLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".metadata.json")
+	lines := func() int {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(contents, []byte("\n"))
+	}
+	// Stores from before the log are still read
+	err := os.WriteFile(path, []byte(`{"old": {"group": "old", "client": "legacy", "files": []}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MetadataStore{Path: path}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if record, ok := store.Get("old"); !ok || record.Client != "legacy" {
+		t.Fatalf("Legacy store not read: %v", record)
+	}
+
+	for _, group := range []string{"a", "b", "c"} {
+		if err := store.Create(GroupRecord{Group: group}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := lines()
+	// Each change only appends the group it changed
+	for i := 0; i < 10; i++ {
+		store.Update("a", func(record *GroupRecord) {
+			record.Files = append(record.Files, FileRecord{Name: fmt.Sprint(i)})
+		})
+	}
+	store.Remove("b")
+	if after := lines(); after != before+11 {
+		t.Fatalf("Expected one line for each change, got %d more", after-before)
+	}
+
+	// A change cut off by a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"group": "c", "record": {"gro`)
+	f.Close()
+	restarted := &MetadataStore{Path: path}
+	if err := restarted.Init(); err != nil {
+		t.Fatal(err)
+	}
+	records := restarted.List()
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 groups after restart, got %v", records)
+	}
+	if record, _ := restarted.Get("a"); len(record.Files) != 10 {
+		t.Fatalf("Expected every change to be replayed, got %v", record.Files)
+	}
+	if _, ok := restarted.Get("b"); ok {
+		t.Fatalf("Removed group restored")
+	}
+	// Reading the log compacts it
+	if n := lines(); n != 3 {
+		t.Fatalf("Expected compacted log to have a line for each group, got %d", n)
+	}
+}
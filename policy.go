@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SQLTaskType is the task type of SQL-based ingestion in policies
+const SQLTaskType = "sql"
+
+// PolicyRule allows some principals to submit some kinds of tasks
+type PolicyRule struct {
+	// Principals and Roles are glob patterns matching the principals this rule applies to.
+	// A rule with neither applies to every principal.
+	Principals []string `json:"principals"`
+	Roles      []string `json:"roles"`
+	// DataSources are glob patterns matching the datasources the principals may ingest into
+	DataSources []string `json:"dataSources"`
+	// TaskTypes are the task types the principals may submit, index, index_parallel, or sql. If empty, all types are allowed.
+	TaskTypes []string `json:"taskTypes"`
+	// AllowOverwrite allows tasks which replace existing data, i.e. native tasks without appendToExisting, or REPLACE statements
+	AllowOverwrite bool `json:"allowOverwrite"`
+	// AllowDropExisting allows native tasks with dropExisting, which drop existing segments in their intervals
+	AllowDropExisting bool `json:"allowDropExisting"`
+}
+
+// Policy decides which tasks each principal may submit. A task is allowed if any rule which applies to its principal allows it.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRequest describes what a submitted task would do
+type PolicyRequest struct {
+	TaskType     string
+	DataSource   string
+	Overwrite    bool
+	DropExisting bool
+}
+
+func LoadPolicy(policyPath string) (*Policy, error) {
+	f, err := os.Open(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	policy := &Policy{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", policyPath, err)
+	}
+	for _, rule := range policy.Rules {
+		for _, pattern := range append(append(append([]string{}, rule.Principals...), rule.Roles...), rule.DataSources...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: Bad pattern %s: %s", policyPath, pattern, err)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (rule *PolicyRule) appliesTo(principal Principal) bool {
+	if len(rule.Principals) == 0 && len(rule.Roles) == 0 {
+		return true
+	}
+	return matchesAny(rule.Principals, principal.Name) || matchesAny(rule.Roles, principal.Roles...)
+}
+
+type errDataSourceNotAllowed struct {
+	dataSource string
+}
+
+func (e errDataSourceNotAllowed) Error() string {
+	return fmt.Sprintf("Ingesting into datasource %q is not allowed", e.dataSource)
+}
+
+// check returns the reason a rule does not allow a task, or nil if it does
+func (rule *PolicyRule) check(request PolicyRequest) error {
+	if !matchesAny(rule.DataSources, request.DataSource) {
+		return errDataSourceNotAllowed{request.DataSource}
+	}
+	if len(rule.TaskTypes) != 0 {
+		allowed := false
+		for _, taskType := range rule.TaskTypes {
+			allowed = allowed || taskType == request.TaskType
+		}
+		if !allowed {
+			return fmt.Errorf("%s tasks are not allowed", request.TaskType)
+		}
+	}
+	if request.Overwrite && !rule.AllowOverwrite {
+		return fmt.Errorf("Overwriting existing data is not allowed, set appendToExisting or use INSERT instead of REPLACE")
+	}
+	if request.DropExisting && !rule.AllowDropExisting {
+		return fmt.Errorf("dropExisting is not allowed")
+	}
+	return nil
+}
+
+// Check returns the reason a principal may not submit a task, or nil if it may.
+// The reason is from the first rule which allows the datasource, if any, as it is the most relevant.
+func (p *Policy) Check(principal Principal, request PolicyRequest) error {
+	var reason error
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(principal) {
+			continue
+		}
+		err := rule.check(request)
+		if err == nil {
+			return nil
+		}
+		if _, ok := reason.(errDataSourceNotAllowed); reason == nil || ok {
+			reason = err
+		}
+	}
+	if reason == nil {
+		return fmt.Errorf("No policy allows principal %q to submit tasks", principal.Name)
+	}
+	return reason
+}
+
+// checkPolicy writes an error response and returns false if the policy does not allow the principal a request was made by to submit a task
+func (s *Submitter) checkPolicy(w http.ResponseWriter, r *http.Request, request PolicyRequest) bool {
+	if s.Policy == nil {
+		return true
+	}
+	err := s.Policy.Check(principalOf(r), request)
+	if err != nil {
+		fmt.Printf("Rejected task from %s (%s): %s\n", r.RemoteAddr, principalOf(r).Name, err)
+		ErrorResponse(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// NativePolicyRequest describes a native batch task spec
+func NativePolicyRequest(taskType string, spec map[string]interface{}) PolicyRequest {
+	dataSchema, _ := spec["dataSchema"].(map[string]interface{})
+	dataSource, _ := dataSchema["dataSource"].(string)
+	ioConfig, _ := spec["ioConfig"].(map[string]interface{})
+	appendToExisting, _ := ioConfig["appendToExisting"].(bool)
+	dropExisting, _ := ioConfig["dropExisting"].(bool)
+	return PolicyRequest{
+		TaskType:     taskType,
+		DataSource:   dataSource,
+		Overwrite:    !appendToExisting,
+		DropExisting: dropExisting,
+	}
+}
+
+// sqlIdentifierPattern matches a quoted or unquoted SQL identifier
+const sqlIdentifierPattern = `"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_]*`
+
+// sqlTargetPattern matches the start of an INSERT or REPLACE statement, after any comments,
+// up to the target table and its optional schema
+var sqlTargetPattern = regexp.MustCompile(`(?is)^(?:\s+|--[^\n]*(?:\n|$)|/\*.*?\*/)*(INSERT|REPLACE)\s+INTO\s+(?:(` + sqlIdentifierPattern + `)\s*\.\s*)?(` + sqlIdentifierPattern + `)`)
+
+// sqlIdentifier unquotes a possibly quoted SQL identifier
+func sqlIdentifier(identifier string) string {
+	identifier = strings.TrimSpace(identifier)
+	if strings.HasPrefix(identifier, `"`) {
+		return strings.ReplaceAll(identifier[1:len(identifier)-1], `""`, `"`)
+	}
+	return identifier
+}
+
+// SQLPolicyRequest describes an SQL-based ingestion statement from the table it inserts into or replaces
+func SQLPolicyRequest(query string) (PolicyRequest, error) {
+	match := sqlTargetPattern.FindStringSubmatch(query)
+	if match == nil {
+		return PolicyRequest{}, fmt.Errorf("Could not determine the datasource the statement ingests into, it must start with INSERT INTO or REPLACE INTO")
+	}
+	if len(match[2]) != 0 {
+		if schema := sqlIdentifier(match[2]); schema != "druid" {
+			return PolicyRequest{}, fmt.Errorf("Statements may only ingest into the druid schema, not %q", schema)
+		}
+	}
+	return PolicyRequest{
+		TaskType:   SQLTaskType,
+		DataSource: sqlIdentifier(match[3]),
+		Overwrite:  strings.EqualFold(match[1], "REPLACE"),
+	}, nil
+}
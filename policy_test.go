@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSQLPolicyRequest(t *testing.T) {
+	cases := map[string]PolicyRequest{
+		"INSERT INTO wikipedia SELECT * FROM TABLE(EXTERN(...))":                       {TaskType: SQLTaskType, DataSource: "wikipedia"},
+		"-- load the data\n/* multi\nline */ insert into \"wiki-pedia\" SELECT 1":      {TaskType: SQLTaskType, DataSource: "wiki-pedia"},
+		"REPLACE INTO druid.\"wiki\"\"quoted\" OVERWRITE ALL SELECT * FROM TABLE(...)": {TaskType: SQLTaskType, DataSource: `wiki"quoted`, Overwrite: true},
+	}
+	for query, expected := range cases {
+		request, err := SQLPolicyRequest(query)
+		if err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+		if request != expected {
+			t.Fatalf("%s: expected %v, got %v", query, expected, request)
+		}
+	}
+	for _, query := range []string{
+		"SELECT * FROM TABLE(EXTERN(...))",
+		"INSERT INTO sys.segments SELECT 1",
+		"WITH x AS (SELECT 1) SELECT * FROM x -- INSERT INTO wikipedia",
+	} {
+		if _, err := SQLPolicyRequest(query); err == nil {
+			t.Fatalf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	submitter.Policy = &Policy{Rules: []PolicyRule{
+		{DataSources: []string{"public-*"}},
+		{Roles: []string{"ingest"}, DataSources: []string{"metrics", "logs-*"}, TaskTypes: []string{"index_parallel", SQLTaskType}, AllowOverwrite: true},
+	}}
+	submitter.Auth = &Auth{Authenticators: []Authenticator{&APIKeyAuthenticator{principals: map[[sha256.Size]byte]Principal{
+		sha256.Sum256([]byte("anyone")):   {Name: "anyone"},
+		sha256.Sum256([]byte("ingester")): {Name: "ingester", Roles: []string{"ingest"}},
+	}}}}
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	submitTo := func(endpoint, apiKey, spec string) *httptest.ResponseRecorder {
+		body, contentType := buildSubmission(t, spec, map[string]string{"data.json": `{"a": 1}`})
+		req := httptest.NewRequest("POST", endpoint, body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Api-Key", apiKey)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	submit := func(apiKey, spec string) *httptest.ResponseRecorder {
+		return submitTo("/tasks/task", apiKey, spec)
+	}
+	spec := func(taskType, dataSource, ioConfig string) string {
+		return `{"type": "` + taskType + `", "spec": {"dataSchema": {"dataSource": "` + dataSource + `"}, "ioConfig": {` + ioConfig + `}}}`
+	}
+	anyone, ingester := "anyone", "ingester"
+	cases := []struct {
+		apiKey string
+		spec   string
+		reason string
+	}{
+		{anyone, spec("index", "public-data", `"appendToExisting": true`), ""},
+		{anyone, spec("index", "public-data", ``), "Overwriting existing data is not allowed"},
+		{anyone, spec("index", "metrics", `"appendToExisting": true`), "Ingesting into datasource"},
+		{ingester, spec("index_parallel", "logs-1", ``), ""},
+		{ingester, spec("index_parallel", "logs-1", `"dropExisting": true`), "dropExisting is not allowed"},
+		{ingester, spec("index", "metrics", ``), "index tasks are not allowed"},
+	}
+	for _, c := range cases {
+		resp := submit(c.apiKey, c.spec)
+		if len(c.reason) == 0 && resp.Code != http.StatusOK {
+			t.Fatalf("%s: expected to be allowed, got %d %s", c.spec, resp.Code, resp.Body.String())
+		}
+		if len(c.reason) != 0 && (resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), c.reason)) {
+			t.Fatalf("%s: expected to be forbidden because %s, got %d %s", c.spec, c.reason, resp.Code, resp.Body.String())
+		}
+	}
+	if len(overlord.specs) != 2 {
+		t.Fatalf("Expected only allowed tasks to reach the Overlord, got %d", len(overlord.specs))
+	}
+	if records := submitter.Metadata.List(); len(records) != 2 {
+		t.Fatalf("Expected files to only be kept for allowed tasks, got %v", records)
+	}
+
+	sql := "REPLACE INTO metrics OVERWRITE ALL SELECT * FROM TABLE(EXTERN(" + InputSourcePlaceholder + ", '{}', '[]')) PARTITIONED BY DAY"
+	if resp := submitTo("/tasks/sql", ingester, sql); resp.Code != http.StatusOK {
+		t.Fatalf("Expected SQL task to be allowed, got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := submitTo("/tasks/sql", anyone, sql); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected SQL task to be forbidden, got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := submitTo("/tasks/sql", ingester, "SELECT * FROM TABLE(EXTERN("+InputSourcePlaceholder+", '{}', '[]'))"); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected SQL task without a target datasource to be forbidden, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	submitter.Policy = &Policy{Rules: []PolicyRule{{Principals: []string{"someone"}, DataSources: []string{"*"}}}}
+	resp := submit(anyone, spec("index", "public-data", `"appendToExisting": true`))
+	if resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), "No policy allows") {
+		t.Fatalf("Expected no rule to apply, got %d %s", resp.Code, resp.Body.String())
+	}
+}
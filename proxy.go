@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// TaskResourceMethods are the Overlord task sub-resources which can be retrieved through the gateway, and the method for each
+var TaskResourceMethods = map[string]string{
+	"status":   "GET",
+	"reports":  "GET",
+	"log":      "GET",
+	"shutdown": "POST",
+}
+
+const BadTaskMsg = "Unknown Task"
+
+const BadTaskResourceMsg = "/task/{id} supports GET for status, reports, and log, and POST for shutdown"
+
+// taskResource splits a request for /task/{id}/{resource} into the task ID and resource.
+// The resource is empty for any other request.
+func (s *Submitter) taskResource(r *http.Request) (string, string) {
+	requested := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, s.ContextPath+SubmitterEndpoint), "/")
+	parts := strings.SplitN(requested, "/", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// Proxy forwards a request for a sub-resource of a task to the Overlord.
+// Only tasks submitted through this gateway can be accessed.
+func (s *Submitter) Proxy(w http.ResponseWriter, r *http.Request, taskID, resource string) {
+	method, ok := TaskResourceMethods[resource]
+	if !ok {
+		ErrorResponse(w, http.StatusNotFound, BadTaskResourceMsg)
+		return
+	}
+	if r.Method != method {
+		ErrorResponse(w, http.StatusMethodNotAllowed, BadTaskResourceMsg)
+		return
+	}
+	record, ok := s.Metadata.FindTask(taskID)
+	if !ok {
+		ErrorResponse(w, http.StatusNotFound, BadTaskMsg)
+		return
+	}
+	if s.Auth != nil && !s.Auth.CanAccess(principalOf(r), &record) {
+		ErrorResponse(w, http.StatusForbidden, NotOwnerMsg)
+		return
+	}
+	taskResponse, err := s.Druid.TaskRequest(method, taskID, resource, r.URL.RawQuery, r)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusBadGateway, InternalErrorMsg)
+		return
+	}
+	defer taskResponse.Body.Close()
+	for name, values := range taskResponse.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(taskResponse.StatusCode)
+	io.Copy(w, taskResponse.Body)
+	// Should probably log this if it fails
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	// Submitted by some other client directly to Druid
+	overlord.setStatus("task-other", TaskStatusRunning)
+
+	cases := []struct {
+		method       string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"GET", "/tasks/task/task-a/status", http.StatusOK, `"statusCode":"RUNNING"`},
+		{"GET", "/tasks/task/task-a/reports", http.StatusOK, `"taskId":"task-a"`},
+		{"GET", "/tasks/task/task-a/log?offset=-100", http.StatusOK, "log for task-a from offset -100"},
+		{"GET", "/tasks/task/task-a/shutdown", http.StatusMethodNotAllowed, ""},
+		{"GET", "/tasks/task/task-a/segments", http.StatusNotFound, ""},
+		{"GET", "/tasks/task/task-other/status", http.StatusNotFound, BadTaskMsg},
+		{"POST", "/tasks/task/task-other/shutdown", http.StatusNotFound, BadTaskMsg},
+		{"POST", "/tasks/task/task-a/shutdown", http.StatusOK, `"task":"task-a"`},
+		{"GET", "/tasks/task/task-a/status", http.StatusOK, `"statusCode":"FAILED"`},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Code != c.expectedCode {
+			t.Fatalf("%s %s: expected %d, got %d %s", c.method, c.path, c.expectedCode, resp.Code, resp.Body.String())
+		}
+		if !strings.Contains(resp.Body.String(), c.expectedBody) {
+			t.Fatalf("%s %s: expected body containing %s, got %s", c.method, c.path, c.expectedBody, resp.Body.String())
+		}
+	}
+	if overlord.statuses["task-other"] != TaskStatusRunning {
+		t.Fatalf("Task not submitted by the gateway was shut down")
+	}
+}
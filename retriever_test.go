@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// submittedFilePath submits a single file and returns the path it is served from by a Retriever at /files
+func submittedFilePath(t *testing.T, submitter *Submitter, overlord *fakeOverlord, name, contents string) string {
+	resp := submitTestTask(t, submitter, map[string]string{name: contents})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	uri, err := url.Parse(submittedInputSource(t, overlord)["uris"].([]interface{})[0].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uri.Path
+}
+
+func TestRetrieverFetch(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	contents := "0123456789abcdef"
+	filePath := submittedFilePath(t, submitter, overlord, "data.json.gz", contents)
+
+	mux := http.NewServeMux()
+	(&Retriever{ContextPath: "/files", Files: submitter.Files, Metadata: submitter.Metadata}).Handle(mux)
+	fetch := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := fetch("GET", filePath, nil)
+	if resp.Code != http.StatusOK || resp.Body.String() != contents {
+		t.Fatalf("Unexpected response: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Content-Type") != "application/gzip" || resp.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Compressed file served with wrong headers: %v", resp.Header())
+	}
+	if resp.Header().Get("Content-Length") != "16" || resp.Header().Get("Last-Modified") == "" {
+		t.Fatalf("Missing length or modification time: %v", resp.Header())
+	}
+	record := submitter.Metadata.List()[0]
+	etag := resp.Header().Get("ETag")
+	if etag != `"`+record.Files[0].SHA256+`"` {
+		t.Fatalf("Expected ETag from checksum %s, got %s", record.Files[0].SHA256, etag)
+	}
+
+	resp = fetch("HEAD", filePath, nil)
+	if resp.Code != http.StatusOK || resp.Body.Len() != 0 || resp.Header().Get("Content-Length") != "16" {
+		t.Fatalf("Unexpected HEAD response: %d %v %q", resp.Code, resp.Header(), resp.Body.String())
+	}
+
+	resp = fetch("GET", filePath, map[string]string{"Range": "bytes=10-"})
+	if resp.Code != http.StatusPartialContent || resp.Body.String() != contents[10:] {
+		t.Fatalf("Unexpected range response: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Content-Range") != "bytes 10-15/16" {
+		t.Fatalf("Unexpected Content-Range: %s", resp.Header().Get("Content-Range"))
+	}
+
+	resp = fetch("GET", filePath, map[string]string{"Range": "bytes=2-4", "If-Range": etag})
+	if resp.Code != http.StatusPartialContent || resp.Body.String() != contents[2:5] {
+		t.Fatalf("Unexpected conditional range response: %d %q", resp.Code, resp.Body.String())
+	}
+
+	resp = fetch("GET", filePath, map[string]string{"If-None-Match": etag})
+	if resp.Code != http.StatusNotModified {
+		t.Fatalf("Expected not modified, got %d", resp.Code)
+	}
+
+	resp = fetch("POST", filePath, nil)
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected method not allowed, got %d", resp.Code)
+	}
+
+	for _, missing := range []string{"/files/file/no-item", "/files/file/no-group/data.json.gz", filePath + ".missing"} {
+		resp = fetch("GET", missing, nil)
+		if resp.Code != http.StatusNotFound {
+			t.Fatalf("Expected not found for %s, got %d", missing, resp.Code)
+		}
+	}
+}
+
+func TestS3FileRanges(t *testing.T) {
+	files, _ := newTestS3FileManager(t)
+	contents := "0123456789abcdef"
+	mux := http.NewServeMux()
+	(&Retriever{ContextPath: "/files", Files: files}).Handle(mux)
+	err := files.Put("group-1", "data.csv", strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/files/file/group-1/data.csv", nil)
+	req.Header.Set("Range", "bytes=4-7")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusPartialContent || resp.Body.String() != contents[4:8] {
+		t.Fatalf("Unexpected range response: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Content-Type") != "text/csv" || resp.Header().Get("ETag") == "" {
+		t.Fatalf("Unexpected headers: %v", resp.Header())
+	}
+}
+
+func TestRetrieverSignedURLs(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	oldSigner := &URLSigner{Keys: [][]byte{[]byte("old")}, TTL: time.Hour}
+	signer := &URLSigner{Keys: [][]byte{[]byte("new"), []byte("old")}, TTL: time.Hour}
+	submitter.InputSource.(*HTTPInputSource).Signer = signer
+	filePath := submittedFilePath(t, submitter, overlord, "data.json.gz", "contents")
+	if !strings.HasSuffix(filePath, ".json.gz") {
+		t.Fatalf("Signed URL must still end with the file name: %s", filePath)
+	}
+	group := submitter.Metadata.List()[0].Group
+
+	mux := http.NewServeMux()
+	(&Retriever{ContextPath: "/files", Files: submitter.Files, Signer: signer}).Handle(mux)
+	fetch := func(path string) int {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp.Code
+	}
+
+	if code := fetch(filePath); code != http.StatusOK {
+		t.Fatalf("Signed URL rejected: %d", code)
+	}
+	expires := time.Now().Add(time.Hour)
+	cases := map[string]int{
+		// Signed with a key which is being rotated out
+		"/files/file/" + oldSigner.SignedPath(group, "data.json.gz", expires):                                       http.StatusOK,
+		"/files/file/" + group + "/data.json.gz":                                                                    http.StatusForbidden,
+		"/files/file/" + signer.SignedPath(group, "data.json.gz", time.Now().Add(-time.Minute)):                     http.StatusForbidden,
+		"/files/file/" + (&URLSigner{Keys: [][]byte{[]byte("unknown")}}).SignedPath(group, "data.json.gz", expires): http.StatusForbidden,
+		strings.Replace(filePath, "/data.json.gz", "/other.json.gz", 1):                                             http.StatusForbidden,
+		strings.Replace(filePath, "/"+group+"/", "/other-group/", 1):                                                http.StatusForbidden,
+	}
+	for path, expected := range cases {
+		if code := fetch(path); code != expected {
+			t.Fatalf("Expected %d for %s, got %d", expected, path, code)
+		}
+	}
+}
+
+func fetchWithCredentials(mux *http.ServeMux, path, username, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if len(username) != 0 {
+		req.SetBasicAuth(username, password)
+	}
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestRetrieverGroupCredentials(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	credentials := &GroupCredentials{Metadata: submitter.Metadata}
+	submitter.InputSource.(*HTTPInputSource).Credentials = credentials
+	filePath := submittedFilePath(t, submitter, overlord, "data.json", "contents")
+	inputSource := submittedInputSource(t, overlord)
+	username, _ := inputSource["httpAuthenticationUsername"].(string)
+	password, _ := inputSource["httpAuthenticationPassword"].(string)
+	if len(username) == 0 || len(password) == 0 {
+		t.Fatalf("Credentials missing from input source: %v", inputSource)
+	}
+	metadataBytes, err := os.ReadFile(submitter.Metadata.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(metadataBytes), password) {
+		t.Fatalf("Password stored in metadata")
+	}
+	err = submitter.Metadata.Create(GroupRecord{Group: "other-group"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUsername, otherPassword, err := credentials.Credentials("other-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	(&Retriever{ContextPath: "/files", Files: submitter.Files, Credentials: credentials}).Handle(mux)
+
+	if resp := fetchWithCredentials(mux, filePath, username, password); resp.Code != http.StatusOK {
+		t.Fatalf("Credentials given to Druid rejected: %d", resp.Code)
+	}
+	resp := fetchWithCredentials(mux, filePath, "", "")
+	if resp.Code != http.StatusUnauthorized || len(resp.Header().Get("WWW-Authenticate")) == 0 {
+		t.Fatalf("Expected a challenge without credentials, got %d %v", resp.Code, resp.Header())
+	}
+	if resp = fetchWithCredentials(mux, filePath, username, password+"0"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected wrong password to be rejected, got %d", resp.Code)
+	}
+	if resp = fetchWithCredentials(mux, filePath, otherUsername, otherPassword.(string)); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected another group's credentials to be rejected, got %d", resp.Code)
+	}
+
+	// Linking another task to the group gives it its own password, without revoking the first task's
+	record, _ := submitter.Metadata.FindTask("task-a")
+	submitMux := http.NewServeMux()
+	submitter.Handle(submitMux)
+	req := httptest.NewRequest("POST", "/tasks/groups/"+record.Group+"/submit", strings.NewReader(testIndexSpec))
+	resp = httptest.NewRecorder()
+	submitMux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Linking task failed: %d %s", resp.Code, resp.Body.String())
+	}
+	linkedIOConfig := overlord.specs[1]["spec"].(map[string]interface{})["ioConfig"].(map[string]interface{})
+	linkedPassword, _ := linkedIOConfig["inputSource"].(map[string]interface{})["httpAuthenticationPassword"].(string)
+	if len(linkedPassword) == 0 || linkedPassword == password {
+		t.Fatalf("Expected linked task to get its own password")
+	}
+	if resp = fetchWithCredentials(mux, filePath, username, password); resp.Code != http.StatusOK {
+		t.Fatalf("First task's credentials rejected after linking another task: %d", resp.Code)
+	}
+	if resp = fetchWithCredentials(mux, filePath, username, linkedPassword); resp.Code != http.StatusOK {
+		t.Fatalf("Linked task's credentials rejected: %d", resp.Code)
+	}
+}
+
+func TestRetrieverStaticCredentials(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	credentials := &StaticCredentials{Username: "druid", Password: "secret", PasswordEnv: "FETCH_PASSWORD"}
+	submitter.InputSource.(*HTTPInputSource).Credentials = credentials
+	filePath := submittedFilePath(t, submitter, overlord, "data.json", "contents")
+	inputSource := submittedInputSource(t, overlord)
+	expected := map[string]interface{}{"type": "environment", "variable": "FETCH_PASSWORD"}
+	if inputSource["httpAuthenticationUsername"] != "druid" || !reflect.DeepEqual(inputSource["httpAuthenticationPassword"], expected) {
+		t.Fatalf("Expected an environment password provider, got %v", inputSource)
+	}
+
+	mux := http.NewServeMux()
+	(&Retriever{ContextPath: "/files", Files: submitter.Files, Credentials: credentials}).Handle(mux)
+	if resp := fetchWithCredentials(mux, filePath, "druid", "secret"); resp.Code != http.StatusOK {
+		t.Fatalf("Static credentials rejected: %d", resp.Code)
+	}
+	if resp := fetchWithCredentials(mux, filePath, "druid", "wrong"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected wrong password to be rejected, got %d", resp.Code)
+	}
+}
+
+// stdoutOf returns what f printed
+func stdoutOf(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(reader)
+		output <- b
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	writer.Close()
+	return string(<-output)
+}
+
+func TestRedactedFetchPasswords(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	submitter.InputSource.(*HTTPInputSource).Credentials = &StaticCredentials{Username: "druid", Password: "static-secret"}
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	submit := func(path, specName, spec string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		specPart, _ := writer.CreateFormField(specName)
+		specPart.Write([]byte(spec))
+		filePart, _ := writer.CreateFormFile("file", "data.json")
+		filePart.Write([]byte(`{"a": 1}`))
+		writer.Close()
+		req := httptest.NewRequest("POST", path, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+		}
+		return resp
+	}
+
+	responses := []*httptest.ResponseRecorder{}
+	logged := stdoutOf(t, func() {
+		responses = append(responses, submit("/tasks/task?envelope=true", "spec.json", testIndexSpec))
+		responses = append(responses, submit("/tasks/sql?envelope=true", "query.sql", testSQLQuery))
+	})
+	if strings.Contains(logged, "static-secret") || !strings.Contains(logged, RedactedPassword) {
+		t.Fatalf("Expected fetch password to be redacted from logs, got %s", logged)
+	}
+	for _, resp := range responses {
+		if strings.Contains(resp.Body.String(), "static-secret") || !strings.Contains(resp.Body.String(), RedactedPassword) {
+			t.Fatalf("Expected fetch password to be redacted from envelope, got %s", resp.Body.String())
+		}
+	}
+	// Druid still gets the password
+	if inputSource := submittedInputSource(t, overlord); inputSource["httpAuthenticationPassword"] != "static-secret" {
+		t.Fatalf("Expected password in submitted spec, got %v", inputSource)
+	}
+	if !strings.Contains(overlord.queries[0].Query, "static-secret") {
+		t.Fatalf("Expected password in submitted query, got %s", overlord.queries[0].Query)
+	}
+}
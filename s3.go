@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// S3MinPartSize is the smallest part S3 accepts in a multipart upload, other than the last part
+	S3MinPartSize = 5 * 1024 * 1024
+	// S3MaxParts is the largest number of parts S3 accepts in a multipart upload
+	S3MaxParts = 10000
+)
+
+// S3FileManager stores each group as a set of objects under a common prefix in an S3-compatible bucket.
+// Files are buffered in memory one part at a time, so memory, not disk, limits concurrent uploads.
+type S3FileManager struct {
+	Endpoint url.URL
+	Bucket   string
+	// Prefix is prepended to all object keys, and should end in a / if it is meant to be a "directory"
+	Prefix string
+	Region string
+	// PathStyle addresses the bucket as {endpoint}/{bucket} instead of {bucket}.{endpoint}, as most self-hosted stores require
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PartSize is how much of a file to buffer before sending it to the store
+	PartSize int
+	Client   *http.Client
+}
+
+// s3ObjectInfo adapts an object, or a common prefix of objects, to os.FileInfo
+type s3ObjectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i *s3ObjectInfo) Name() string       { return i.name }
+func (i *s3ObjectInfo) Size() int64        { return i.size }
+func (i *s3ObjectInfo) ModTime() time.Time { return i.modTime }
+func (i *s3ObjectInfo) IsDir() bool        { return i.isDir }
+func (i *s3ObjectInfo) Sys() interface{}   { return nil }
+func (i *s3ObjectInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (s *S3FileManager) key(group, item string) string {
+	return s.Prefix + group + "/" + item
+}
+
+// s3Escape escapes a string as required by AWS Signature Version 4, which is stricter than url.PathEscape
+func s3Escape(s string, escapeSlash bool) string {
+	escaped := strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func (s *S3FileManager) objectURL(key string, query url.Values) url.URL {
+	objectURL := s.Endpoint
+	objectPath := strings.TrimSuffix(objectURL.Path, "/")
+	if s.PathStyle {
+		objectPath += "/" + s.Bucket
+	} else {
+		objectURL.Host = s.Bucket + "." + objectURL.Host
+	}
+	objectPath += "/" + key
+	objectURL.Path = objectPath
+	objectURL.RawPath = s3Escape(objectPath, false)
+	objectURL.RawQuery = s3CanonicalQuery(query)
+	return objectURL
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signV4 adds AWS Signature Version 4 headers to a request. All headers already set on the request are signed.
+func signV4(req *http.Request, payloadHash, region, service, accessKeyID, secretAccessKey, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(sessionToken) != 0 {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for ix, value := range values {
+			trimmed[ix] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalQuery := s3CanonicalQuery(req.URL.Query())
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func (s *S3FileManager) do(method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	objectURL := s.objectURL(key, query)
+	req, err := http.NewRequest(method, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	// Anonymous access if no credentials are provided
+	if len(s.AccessKeyID) != 0 {
+		signV4(req, sha256Hex(body), s.Region, "s3", s.AccessKeyID, s.SecretAccessKey, s.SessionToken, time.Now())
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// responseError consumes a non-successful response, and returns an error describing it
+func (s *S3FileManager) responseError(resp *http.Response, key string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: resp.Request.Method, Path: key, Err: os.ErrNotExist}
+	}
+	s3Err := s3Error{}
+	body, _ := io.ReadAll(resp.Body)
+	err := xml.Unmarshal(body, &s3Err)
+	if err != nil || len(s3Err.Code) == 0 {
+		return fmt.Errorf("S3 %s %s returned %s: %s", resp.Request.Method, key, resp.Status, string(body))
+	}
+	return fmt.Errorf("S3 %s %s returned %s: %s: %s", resp.Request.Method, key, resp.Status, s3Err.Code, s3Err.Message)
+}
+
+func (s *S3FileManager) Init() error {
+	resp, err := s.do("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp, s.Bucket)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3FileManager) putObject(key string, contents []byte) error {
+	resp, err := s.do("PUT", key, nil, nil, contents)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp, key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3FileManager) Put(group, item string, contents io.Reader) error {
+	key := s.key(group, item)
+	buf := make([]byte, s.PartSize)
+	n, err := io.ReadFull(contents, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(key, buf[:n])
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp, key)
+	}
+	initiated := s3InitiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	parts, err := s.uploadParts(key, initiated.UploadID, buf[:n], contents)
+	if err == nil {
+		err = s.completeMultipartUpload(key, initiated.UploadID, parts)
+	}
+	if err != nil {
+		resp, abortErr := s.do("DELETE", key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3FileManager) uploadParts(key, uploadID string, firstPart []byte, rest io.Reader) ([]s3CompletedPart, error) {
+	parts := []s3CompletedPart{}
+	part := firstPart
+	buf := make([]byte, len(firstPart))
+	for partNumber := 1; ; partNumber++ {
+		if partNumber > S3MaxParts {
+			return nil, fmt.Errorf("%s is too large to upload to S3 with a part size of %d bytes", key, s.PartSize)
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, err := s.do("PUT", key, query, nil, part)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s.responseError(resp, key)
+		}
+		resp.Body.Close()
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(rest, buf)
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		part = buf[:n]
+	}
+}
+
+func (s *S3FileManager) completeMultipartUpload(key, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("POST", key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp, key)
+	}
+	defer resp.Body.Close()
+	// S3 can report a failure to complete an upload with a 200 status
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	s3Err := s3Error{}
+	if xml.Unmarshal(respBody, &s3Err) == nil && len(s3Err.Code) != 0 {
+		return fmt.Errorf("S3 failed to complete upload of %s: %s: %s", key, s3Err.Code, s3Err.Message)
+	}
+	return nil
+}
+
+// s3File reads an object with ranged requests, so that seeking does not require reading the skipped bytes
+type s3File struct {
+	files  *S3FileManager
+	key    string
+	info   os.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		headers := http.Header{}
+		if f.offset != 0 {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		}
+		resp, err := f.files.do("GET", f.key, nil, headers, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			return 0, f.files.responseError(resp, f.key)
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return f.offset, fmt.Errorf("Cannot seek to negative offset %d", offset)
+	}
+	if offset != f.offset {
+		f.Close()
+		f.offset = offset
+	}
+	return f.offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (s *S3FileManager) Get(group, item string) (File, error) {
+	info, err := s.Stat(group, item)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{files: s, key: s.key(group, item), info: info}, nil
+}
+
+func (s *S3FileManager) Stat(group, item string) (os.FileInfo, error) {
+	key := s.key(group, item)
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError(resp, key)
+	}
+	resp.Body.Close()
+	info := &s3ObjectInfo{name: item, size: resp.ContentLength}
+	info.modTime, err = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// listObjects calls visit for every object whose key begins with prefix
+func (s *S3FileManager) listObjects(prefix string, visit func(key string, info *s3ObjectInfo) error) error {
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if len(continuationToken) != 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s.responseError(resp, prefix)
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			err = visit(object.Key, &s3ObjectInfo{name: object.Key, size: object.Size, modTime: object.LastModified})
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *S3FileManager) Delete(group string) error {
+	keys := []string{}
+	err := s.listObjects(s.key(group, ""), func(key string, _ *s3ObjectInfo) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		resp, err := s.do("DELETE", key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			return s.responseError(resp, key)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *S3FileManager) ListGroups() (map[string]os.FileInfo, error) {
+	groups := map[string]os.FileInfo{}
+	err := s.listObjects(s.Prefix, func(key string, object *s3ObjectInfo) error {
+		group := strings.SplitN(strings.TrimPrefix(key, s.Prefix), "/", 2)[0]
+		// Hidden entries are gateway state, not groups
+		if HiddenGroup(group) {
+			return nil
+		}
+		// Like a directory, a group was last modified when its newest file was
+		info, ok := groups[group].(*s3ObjectInfo)
+		if !ok {
+			info = &s3ObjectInfo{name: group, isDir: true}
+			groups[group] = info
+		}
+		info.size += object.size
+		if object.modTime.After(info.modTime) {
+			info.modTime = object.modTime
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
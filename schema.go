@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sampledRows is how many rows of each file are read to infer a schema
+const sampledRows = 1000
+
+// timestampColumnNames are the names of columns which are most likely to be the timestamp, most likely first
+var timestampColumnNames = []string{"__time", "timestamp", "time", "ts", "datetime", "date", "event_time", "eventtime", "created_at", "createdat"}
+
+var isoTimestamp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(T\d{2}(:\d{2}(:\d{2}([.,]\d+)?)?)?(Z|[+-]\d{2}(:?\d{2})?)?)?$`)
+var sqlTimestamp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}$`)
+var sqlTimestampMillis = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3}$`)
+
+// timestampFormat returns the Druid timestampSpec format of a value, or empty if it does not look like a timestamp.
+// Numbers are taken to be seconds, milliseconds, microseconds, or nanoseconds since the epoch by their magnitude,
+// i.e. roughly between 1973 and 2286.
+func timestampFormat(value string) string {
+	switch {
+	case isoTimestamp.MatchString(value):
+		return "iso"
+	case sqlTimestamp.MatchString(value):
+		return "yyyy-MM-dd HH:mm:ss"
+	case sqlTimestampMillis.MatchString(value):
+		return "yyyy-MM-dd HH:mm:ss.SSS"
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	switch {
+	case err != nil:
+		return ""
+	case n >= 1e8 && n < 1e10:
+		return "posix"
+	case n >= 1e11 && n < 1e13:
+		return "millis"
+	case n >= 1e14 && n < 1e16:
+		return "micro"
+	case n >= 1e17:
+		return "nano"
+	}
+	return ""
+}
+
+// columnSample is what was seen of a column in the sampled rows
+type columnSample struct {
+	Name string
+	// values is how many non-null values were seen
+	values int
+	// nested is true if any value was a JSON object or array, which are not inferred
+	nested    bool
+	notLong   bool
+	notDouble bool
+	// timestampFormat is the format every value shared, unless notTimestamp
+	timestampFormat string
+	notTimestamp    bool
+}
+
+func (c *columnSample) add(value string) {
+	c.values++
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		c.notLong = true
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		c.notDouble = true
+	}
+	format := timestampFormat(value)
+	if len(format) == 0 || (len(c.timestampFormat) != 0 && format != c.timestampFormat) {
+		c.notTimestamp = true
+	}
+	c.timestampFormat = format
+}
+
+// isTimestamp returns true if every value seen looks like a timestamp in the same format
+func (c *columnSample) isTimestamp() bool {
+	return c.values != 0 && !c.nested && !c.notTimestamp
+}
+
+// columnSamples are the columns seen in the sampled rows, in the order they were first seen
+type columnSamples struct {
+	columns []*columnSample
+	byName  map[string]*columnSample
+}
+
+func newColumnSamples() *columnSamples {
+	return &columnSamples{byName: map[string]*columnSample{}}
+}
+
+// add records a value of a column, which is nil for nested values
+func (c *columnSamples) add(column string, value *string) {
+	sample, ok := c.byName[column]
+	if !ok {
+		sample = &columnSample{Name: column}
+		c.byName[column] = sample
+		c.columns = append(c.columns, sample)
+	}
+	if value == nil {
+		sample.nested = true
+	} else {
+		sample.add(*value)
+	}
+}
+
+// Timestamp returns the column which is most likely to be the timestamp, and its format, or false if none looks like one.
+// Columns named like timestamps are preferred, then columns of dates, and only then numbers in columns named like times,
+// as other numbers, such as IDs, can fall in the same ranges.
+func (c *columnSamples) Timestamp() (*columnSample, bool) {
+	for _, name := range timestampColumnNames {
+		for _, column := range c.columns {
+			if column.isTimestamp() && strings.EqualFold(column.Name, name) {
+				return column, true
+			}
+		}
+	}
+	for _, column := range c.columns {
+		if column.isTimestamp() && (column.timestampFormat == "iso" || strings.HasPrefix(column.timestampFormat, "yyyy")) {
+			return column, true
+		}
+	}
+	for _, column := range c.columns {
+		lowerName := strings.ToLower(column.Name)
+		if column.isTimestamp() && (strings.Contains(lowerName, "time") || strings.Contains(lowerName, "date")) {
+			return column, true
+		}
+	}
+	return nil, false
+}
+
+// Dimensions returns a Druid dimensionsSpec dimension for each column except the timestamp, typed by the values seen.
+// Nested columns are left out, as they need a flattenSpec or the json type, which the gateway cannot choose.
+func (c *columnSamples) Dimensions(timestampColumn string) []interface{} {
+	dimensions := []interface{}{}
+	for _, column := range c.columns {
+		if column.Name == timestampColumn || column.nested {
+			continue
+		}
+		dimensionType := "string"
+		switch {
+		case column.values == 0:
+		case !column.notLong:
+			dimensionType = "long"
+		case !column.notDouble:
+			dimensionType = "double"
+		}
+		dimensions = append(dimensions, map[string]interface{}{"type": dimensionType, "name": column.Name})
+	}
+	return dimensions
+}
+
+// stringList returns a list of strings from a spec, which is either decoded JSON or was set by the gateway
+func stringList(v interface{}) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		strs := make([]string, 0, len(list))
+		for _, item := range list {
+			str, _ := item.(string)
+			strs = append(strs, str)
+		}
+		return strs
+	}
+	return nil
+}
+
+// sampleRows reads the rows from the start of a file in an inputFormat, and adds their values to columns
+func sampleRows(inputFormat map[string]interface{}, sample []byte, truncated bool, columns *columnSamples) error {
+	sample = bytes.TrimPrefix(sample, []byte("\xef\xbb\xbf"))
+	format, _ := declaredFormat(inputFormat)
+	switch format.Type {
+	case "json":
+		return sampleJSONRows(sample, columns)
+	case "csv", "tsv":
+		return sampleDelimitedRows(inputFormat, format.Delimiter, sample, truncated, columns)
+	}
+	return fmt.Errorf("Cannot infer a schema from %s files, only json, csv, and tsv, set spec.dataSchema.timestampSpec and spec.dataSchema.dimensionsSpec", format.Type)
+}
+
+// sampleJSONRows reads newline-delimited JSON objects, keeping their fields in order. The last object may be cut off,
+// which ends the sample rather than failing it.
+func sampleJSONRows(sample []byte, columns *columnSamples) error {
+	decoder := json.NewDecoder(bytes.NewReader(sample))
+	for row := 0; row < sampledRows; row++ {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		if token != json.Delim('{') {
+			return fmt.Errorf("Cannot infer a schema from JSON which is not a series of objects")
+		}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil
+			}
+			raw := json.RawMessage{}
+			if err := decoder.Decode(&raw); err != nil {
+				return nil
+			}
+			column, _ := key.(string)
+			switch {
+			case bytes.Equal(raw, []byte("null")):
+			case raw[0] == '{' || raw[0] == '[':
+				columns.add(column, nil)
+			case raw[0] == '"':
+				var value string
+				json.Unmarshal(raw, &value)
+				if len(value) != 0 {
+					columns.add(column, &value)
+				}
+			default:
+				value := string(raw)
+				columns.add(column, &value)
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// sampleDelimitedRows reads csv or tsv rows, naming their columns as Druid would from the inputFormat
+func sampleDelimitedRows(inputFormat map[string]interface{}, delimiter string, sample []byte, truncated bool, columns *columnSamples) error {
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(sample))
+	scanner.Buffer(make([]byte, 0, sniffSize), sniffSize+1)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); len(strings.TrimSpace(line)) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	// The last line may have been cut off
+	if truncated && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+	skip, _ := inputFormat["skipHeaderRows"].(float64)
+	if int(skip) >= len(lines) {
+		return nil
+	}
+	lines = lines[int(skip):]
+
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.Comma = []rune(delimiter)[0]
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	names := stringList(inputFormat["columns"])
+	if findColumns, _ := inputFormat["findColumnsFromHeader"].(bool); findColumns {
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		names = header
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("Cannot infer a schema without column names, set spec.ioConfig.inputFormat.columns or findColumnsFromHeader")
+	}
+	for row := 0; row < sampledRows; row++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for i, value := range fields {
+			if i == len(names) {
+				break
+			}
+			if value = strings.TrimSpace(value); len(value) != 0 {
+				columns.add(names[i], &value)
+			}
+		}
+	}
+	return nil
+}
+
+// completeTaskSpec fills in the parts of a partial native task spec which inferring the schema does not cover, where they are missing,
+// so that only the parts which differ from the defaults need to be given
+func completeTaskSpec(taskSpec map[string]interface{}, dataSource string) {
+	if _, ok := taskSpec["type"]; !ok {
+		taskSpec["type"] = "index_parallel"
+	}
+	taskType, _ := taskSpec["type"].(string)
+	if _, ok := taskSpec["spec"]; !ok {
+		taskSpec["spec"] = map[string]interface{}{}
+	}
+	spec, ok := taskSpec["spec"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	section := func(parent map[string]interface{}, key string) map[string]interface{} {
+		if _, ok := parent[key]; !ok {
+			parent[key] = map[string]interface{}{}
+		}
+		child, _ := parent[key].(map[string]interface{})
+		return child
+	}
+	setDefault := func(m map[string]interface{}, key string, value interface{}) {
+		if _, ok := m[key]; !ok && m != nil {
+			m[key] = value
+		}
+	}
+	dataSchema := section(spec, "dataSchema")
+	if dataSchema != nil && len(dataSource) != 0 {
+		dataSchema["dataSource"] = dataSource
+	}
+	if dataSchema != nil {
+		granularitySpec := section(dataSchema, "granularitySpec")
+		setDefault(granularitySpec, "segmentGranularity", "DAY")
+		setDefault(granularitySpec, "queryGranularity", "NONE")
+		setDefault(granularitySpec, "rollup", false)
+	}
+	setDefault(section(spec, "ioConfig"), "type", taskType)
+	setDefault(section(spec, "tuningConfig"), "type", taskType)
+}
+
+// inferSchema samples the files of a group to fill in the timestampSpec and dimensionsSpec of a native task spec, where they are missing.
+// If they cannot be inferred, the error is an errBadFiles.
+func inferSchema(taskSpec, ioConfig map[string]interface{}, group string, items []string, open func(item string) (io.ReadCloser, error)) error {
+	spec, _ := taskSpec["spec"].(map[string]interface{})
+	dataSchema, ok := spec["dataSchema"].(map[string]interface{})
+	if !ok {
+		return errBadFiles{fmt.Errorf("%s", BadIndexTaskSpecMsg)}
+	}
+	// Specs with a legacy parser describe their schema there instead
+	if _, ok := dataSchema["parser"]; ok {
+		return nil
+	}
+	_, hasTimestamp := dataSchema["timestampSpec"]
+	dimensionsSpec, _ := dataSchema["dimensionsSpec"].(map[string]interface{})
+	dimensions, _ := dimensionsSpec["dimensions"].([]interface{})
+	hasDimensions := len(dimensions) != 0 || dimensionsSpec["useSchemaDiscovery"] == true
+	if hasTimestamp && hasDimensions {
+		return nil
+	}
+	inputFormat, _ := ioConfig["inputFormat"].(map[string]interface{})
+
+	columns := newColumnSamples()
+	for i, item := range items {
+		if i == maxSniffedFiles {
+			break
+		}
+		f, err := open(item)
+		if err != nil {
+			return err
+		}
+		sample, truncated, err := sampleFile(item, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		err = sampleRows(inputFormat, sample, truncated, columns)
+		if err != nil {
+			return errBadFiles{fmt.Errorf("%s: %s", item, err)}
+		}
+	}
+	if len(columns.columns) == 0 {
+		return errBadFiles{fmt.Errorf("Could not read any rows from the files to infer a schema from")}
+	}
+
+	if !hasTimestamp {
+		timestamp, ok := columns.Timestamp()
+		if !ok {
+			return errBadFiles{fmt.Errorf("Could not find a timestamp column, set spec.dataSchema.timestampSpec")}
+		}
+		fmt.Printf("Inferred timestamp column %s with format %s for group %s\n", timestamp.Name, timestamp.timestampFormat, group)
+		dataSchema["timestampSpec"] = map[string]interface{}{"column": timestamp.Name, "format": timestamp.timestampFormat}
+	}
+	if !hasDimensions {
+		timestampSpec, _ := dataSchema["timestampSpec"].(map[string]interface{})
+		timestampColumn, _ := timestampSpec["column"].(string)
+		if _, ok := timestampSpec["column"]; !ok {
+			timestampColumn = "timestamp"
+		}
+		if dimensionsSpec == nil {
+			dimensionsSpec = map[string]interface{}{}
+			dataSchema["dimensionsSpec"] = dimensionsSpec
+		}
+		dimensionsSpec["dimensions"] = columns.Dimensions(timestampColumn)
+		fmt.Printf("Inferred %d dimensions for group %s\n", len(dimensionsSpec["dimensions"].([]interface{})), group)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSchemaSampling(t *testing.T) {
+	for value, expected := range map[string]string{
+		"2023-01-02":                    "iso",
+		"2023-01-02T03:04:05.678Z":      "iso",
+		"2023-01-02T03:04:05+01:00":     "iso",
+		"2023-01-02 03:04:05":           "yyyy-MM-dd HH:mm:ss",
+		"2023-01-02 03:04:05.678":       "yyyy-MM-dd HH:mm:ss.SSS",
+		"1672628645":                    "posix",
+		"1672628645678":                 "millis",
+		"1672628645678901":              "micro",
+		"1672628645678901234":           "nano",
+		"42":                            "",
+		"1.5":                           "",
+		"yesterday":                     "",
+		"2023-01-02 03:04:05 yesterday": "",
+	} {
+		if format := timestampFormat(value); format != expected {
+			t.Fatalf("Expected %q to have format %q, got %q", value, expected, format)
+		}
+	}
+
+	for name, c := range map[string]struct {
+		inputFormat string
+		sample      string
+		timestamp   string
+		dimensions  string
+	}{
+		"json": {
+			`{"type": "json"}`,
+			`{"id": 1234567890, "ts": 1672628645678, "page": "a", "added": 1, "delta": 0.5, "tags": ["x"], "user": null}` + "\n" +
+				`{"id": 1234567891, "ts": 1672628645679, "page": "b", "added": 2, "delta": 3, "user": "me"}` + "\n" +
+				`{"id": 12345`,
+			"ts",
+			`[{"name":"id","type":"long"},{"name":"page","type":"string"},{"name":"added","type":"long"},{"name":"delta","type":"double"},{"name":"user","type":"string"}]`,
+		},
+		"csv with header": {
+			`{"type": "csv", "findColumnsFromHeader": true, "skipHeaderRows": 1}`,
+			"# export\ncount,when,page\n3,2023-01-02 03:04:05,a\n4,2023-01-03 03:04:05,\n",
+			"when",
+			`[{"name":"count","type":"long"},{"name":"page","type":"string"}]`,
+		},
+		"tsv with columns": {
+			`{"type": "tsv", "delimiter": "|", "columns": ["page", "created_time"]}`,
+			"a|1672628645\nb|1672628646\n",
+			"created_time",
+			`[{"name":"page","type":"string"}]`,
+		},
+	} {
+		inputFormat := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(c.inputFormat), &inputFormat); err != nil {
+			t.Fatal(err)
+		}
+		columns := newColumnSamples()
+		if err := sampleRows(inputFormat, []byte(c.sample), true, columns); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		timestamp, ok := columns.Timestamp()
+		if !ok || timestamp.Name != c.timestamp {
+			t.Fatalf("%s: expected timestamp column %s, got %#v", name, c.timestamp, timestamp)
+		}
+		dimensions, _ := json.Marshal(columns.Dimensions(timestamp.Name))
+		if string(dimensions) != c.dimensions {
+			t.Fatalf("%s: unexpected dimensions %s", name, dimensions)
+		}
+	}
+
+	// Numbers which could be times are only taken to be one in a column named like one
+	columns := newColumnSamples()
+	sampleRows(map[string]interface{}{"type": "json"}, []byte(`{"id": 1672628645, "page": "a"}`), false, columns)
+	if timestamp, ok := columns.Timestamp(); ok {
+		t.Fatalf("Expected no timestamp column, got %#v", timestamp)
+	}
+}
+
+func TestSchemaInference(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	submit := func(query string, spec *string, files map[string]string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		submitter.Handle(mux)
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		if spec != nil {
+			specPart, _ := writer.CreateFormField("spec.json")
+			specPart.Write([]byte(*spec))
+		}
+		for name, contents := range files {
+			filePart, _ := writer.CreateFormFile("file", name)
+			filePart.Write([]byte(contents))
+		}
+		writer.Close()
+		req := httptest.NewRequest("POST", "/tasks/task?"+query, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	events := map[string]string{"events.json": `{"timestamp": "2023-01-02T03:04:05Z", "page": "a", "added": 1}` + "\n"}
+
+	// With a dataSource, no spec is needed at all
+	resp := submit("inferSchema=true&dataSource=edits", nil, events)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	envelope := SubmissionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || envelope.TaskID != "task-a" {
+		t.Fatalf("Expected the generated spec to be returned, got %v %v", envelope, err)
+	}
+	for _, expected := range []string{
+		`"type":"index_parallel"`,
+		`"dataSource":"edits"`,
+		`"timestampSpec":{"column":"timestamp","format":"iso"}`,
+		`"dimensions":[{"name":"page","type":"string"},{"name":"added","type":"long"}]`,
+		`"segmentGranularity":"DAY"`,
+		`"inputFormat":{"type":"json"}`,
+	} {
+		if !strings.Contains(string(envelope.Spec), expected) {
+			t.Fatalf("Expected %s in generated spec %s", expected, envelope.Spec)
+		}
+	}
+
+	// Parts of the schema which are given are kept
+	spec := `{"spec": {"dataSchema": {"dataSource": "test", "timestampSpec": {"column": "page", "format": "auto"}, "granularitySpec": {"segmentGranularity": "HOUR"}}}}`
+	if resp := submit("inferSchema=true", &spec, events); resp.Code != http.StatusOK {
+		t.Fatalf("Submission of partial spec failed: %d %s", resp.Code, resp.Body.String())
+	}
+	overlord.lock.Lock()
+	submitted, _ := json.Marshal(overlord.specs[1])
+	overlord.lock.Unlock()
+	for _, expected := range []string{
+		`"timestampSpec":{"column":"page","format":"auto"}`,
+		`"dimensions":[{"name":"timestamp","type":"string"},{"name":"added","type":"long"}]`,
+		`"segmentGranularity":"HOUR"`,
+		`"dataSource":"test"`,
+	} {
+		if !strings.Contains(string(submitted), expected) {
+			t.Fatalf("Expected %s in submitted spec %s", expected, submitted)
+		}
+	}
+
+	for _, c := range []struct {
+		files    map[string]string
+		expected string
+	}{
+		{map[string]string{"a.json": `{"id": 1, "page": "a"}`}, "timestampSpec"},
+		{map[string]string{"a.parquet": "PAR1\x00\x00"}, "parquet"},
+	} {
+		resp := submit("inferSchema=true&dataSource=edits", nil, c.files)
+		if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), c.expected) {
+			t.Fatalf("Expected %v to be rejected for %s, got %d %s", c.files, c.expected, resp.Code, resp.Body.String())
+		}
+	}
+}
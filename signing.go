@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BadSignatureMsg = "Missing, invalid, or expired signature"
+
+// URLSigner signs fetch URLs so that only Druid tasks the gateway submitted can fetch files, and only until
+// they expire. The signature is part of the path rather than the query, because Druid detects compressed
+// files from the end of the URI.
+type URLSigner struct {
+	// Keys are used to verify signatures. The first key is used to sign, so keys can be rotated by adding a
+	// new key first, and removing the old key once URLs signed with it have expired.
+	Keys [][]byte
+	// TTL is how long signed URLs are valid for
+	TTL time.Duration
+}
+
+// ReadURLSigningKeys reads one key per line, ignoring blank lines and lines starting with #
+func ReadURLSigningKeys(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := [][]byte{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, []byte(line))
+	}
+	return keys, scanner.Err()
+}
+
+func signature(key []byte, expires, group, item string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", expires, group, item)
+	return mac.Sum(nil)
+}
+
+// SignedPath returns the path to fetch a file from relative to the Retriever's endpoint, valid until expires
+func (s *URLSigner) SignedPath(group, item string, expires time.Time) string {
+	expiresStr := strconv.FormatInt(expires.Unix(), 10)
+	sig := base64.RawURLEncoding.EncodeToString(signature(s.Keys[0], expiresStr, group, item))
+	return expiresStr + "/" + sig + "/" + group + "/" + item
+}
+
+// Verify checks a signature produced by SignedPath with any of the keys
+func (s *URLSigner) Verify(expires, sig, group, item string, now time.Time) bool {
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > expiresUnix {
+		return false
+	}
+	sigBytes, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	for _, key := range s.Keys {
+		if hmac.Equal(sigBytes, signature(key, expires, group, item)) {
+			return true
+		}
+	}
+	return false
+}
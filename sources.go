@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+// SourcesPartName is the name of the part of a submission listing URLs for the gateway to download, instead of uploading files
+const SourcesPartName = "sources"
+
+const BadSourcesMsg = "The sources part must be a JSON list of objects with a url, and optionally a filename and headers, and is only allowed if the gateway is configured with allowed hosts"
+
+// RemoteSource is a URL to download a file to ingest from
+type RemoteSource struct {
+	URL string `json:"url"`
+	// Filename is the name to store the file under. Defaults to the last element of the URL's path.
+	Filename string `json:"filename"`
+	// Headers are sent with the request, e.g. for authentication
+	Headers map[string]string `json:"headers"`
+}
+
+// errBadSource is returned when a source cannot be downloaded because of how it was requested, rather than the gateway
+type errBadSource struct {
+	err error
+}
+
+func (e errBadSource) Error() string {
+	return e.err.Error()
+}
+
+// RemoteSources downloads files on behalf of submissions. To keep the gateway from being used to reach
+// anything it can, only hosts matching AllowedHosts may be downloaded from, including after redirects.
+type RemoteSources struct {
+	// AllowedHosts are glob patterns matching the host names, or host names and ports, which may be downloaded from
+	AllowedHosts []string
+	// MaxSize is the largest file, in bytes, which may be downloaded
+	MaxSize int64
+	Client  *http.Client
+
+	// slots limits how many downloads happen at once, across all submissions
+	slots chan struct{}
+}
+
+func NewRemoteSources(allowedHosts []string, maxSize int64, concurrency int, timeout time.Duration) (*RemoteSources, error) {
+	for _, pattern := range allowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Bad host pattern %s: %s", pattern, err)
+		}
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("Download concurrency must be at least 1")
+	}
+	rs := &RemoteSources{
+		AllowedHosts: allowedHosts,
+		MaxSize:      maxSize,
+		slots:        make(chan struct{}, concurrency),
+	}
+	rs.Client = &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errBadSource{fmt.Errorf("Too many redirects downloading %s", via[0].URL.Redacted())}
+			}
+			return rs.checkURL(req.URL)
+		},
+	}
+	return rs, nil
+}
+
+// checkURL returns an error if a URL may not be downloaded from
+func (rs *RemoteSources) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errBadSource{fmt.Errorf("Only http and https URLs may be downloaded, not %s", u.Redacted())}
+	}
+	if !matchesAny(rs.AllowedHosts, u.Hostname(), u.Host) {
+		return errBadSource{fmt.Errorf("Downloading from %s is not allowed", u.Host)}
+	}
+	return nil
+}
+
+// ParseRemoteSources reads the list of sources from a submission, and checks that each may be downloaded
+func (rs *RemoteSources) ParseRemoteSources(r io.Reader) ([]RemoteSource, error) {
+	sources := []RemoteSource{}
+	err := json.NewDecoder(r).Decode(&sources)
+	if err != nil {
+		return nil, errBadSource{err}
+	}
+	for i, source := range sources {
+		u, err := url.Parse(source.URL)
+		if err != nil {
+			return nil, errBadSource{err}
+		}
+		err = rs.checkURL(u)
+		if err != nil {
+			return nil, err
+		}
+		if len(source.Filename) == 0 {
+			source.Filename = path.Base(u.Path)
+		}
+		filename, ok := submittedFilename(source.Filename)
+		if !ok {
+			return nil, errBadSource{fmt.Errorf("Bad filename for %s, set one explicitly", u.Redacted())}
+		}
+		sources[i].Filename = filename
+	}
+	return sources, nil
+}
+
+// sizeLimitedReader fails once more than a limited number of bytes are read
+type sizeLimitedReader struct {
+	io.Reader
+	source string
+	limit  int64
+	read   int64
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return n, errBadSource{fmt.Errorf("%s is larger than the limit of %d bytes", r.source, r.limit)}
+	}
+	return n, err
+}
+
+func (rs *RemoteSources) download(ctx context.Context, source RemoteSource, store func(filename string, contents io.Reader) error) error {
+	select {
+	case rs.slots <- struct{}{}:
+		defer func() { <-rs.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", source.URL, nil)
+	if err != nil {
+		return errBadSource{err}
+	}
+	for name, value := range source.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := rs.Client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			if badSource, ok := urlErr.Err.(errBadSource); ok {
+				return badSource
+			}
+		}
+		return errBadSource{fmt.Errorf("Downloading %s failed: %s", req.URL.Redacted(), err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errBadSource{fmt.Errorf("Downloading %s failed: %s", req.URL.Redacted(), resp.Status)}
+	}
+	if rs.MaxSize > 0 && resp.ContentLength > rs.MaxSize {
+		return errBadSource{fmt.Errorf("%s is larger than the limit of %d bytes", req.URL.Redacted(), rs.MaxSize)}
+	}
+	var contents io.Reader = resp.Body
+	if rs.MaxSize > 0 {
+		contents = &sizeLimitedReader{Reader: resp.Body, source: req.URL.Redacted(), limit: rs.MaxSize}
+	}
+	return store(source.Filename, contents)
+}
+
+// Download downloads every source at once, up to the concurrency limit, and passes each to store, which must be
+// safe to call concurrently. If any download fails, the rest are cancelled, and the first error is returned.
+func (rs *RemoteSources) Download(ctx context.Context, sources []RemoteSource, store func(filename string, contents io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source RemoteSource) {
+			defer wg.Done()
+			err := rs.download(ctx, source, store)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(source)
+	}
+	wg.Wait()
+	return firstErr
+}
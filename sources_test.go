@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteSources(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/public/a.json":
+			w.Write([]byte(`{"a": 1}`))
+		case "/private/export":
+			if r.Header.Get("Authorization") != "Bearer upstream-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"b": 2}`))
+		case "/large.json":
+			w.Write([]byte(strings.Repeat(" ", 1024)))
+		case "/redirect":
+			http.Redirect(w, r, "http://metadata.internal/latest", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	submit := func(sources string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		specPart, _ := writer.CreateFormField("spec.json")
+		specPart.Write([]byte(testIndexSpec))
+		sourcesPart, _ := writer.CreateFormField(SourcesPartName)
+		sourcesPart.Write([]byte(sources))
+		filePart, _ := writer.CreateFormFile("file", "uploaded.json")
+		filePart.Write([]byte(`{"c": 3}`))
+		writer.Close()
+		req := httptest.NewRequest("POST", "/tasks/task", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	sources := `[
+		{"url": "` + upstream.URL + `/public/a.json"},
+		{"url": "` + upstream.URL + `/private/export", "filename": "b.json", "headers": {"Authorization": "Bearer upstream-token"}}
+	]`
+
+	if resp := submit(sources); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected sources to be rejected when not configured, got %d %s", resp.Code, resp.Body.String())
+	}
+	var err error
+	submitter.Sources, err = NewRemoteSources([]string{"127.0.0.1"}, 512, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := submit(sources)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	record := submitter.Metadata.List()[0]
+	uris := []string{}
+	for _, uri := range submittedInputSource(t, overlord)["uris"].([]interface{}) {
+		uris = append(uris, strings.TrimPrefix(uri.(string), "http://gateway/files/file/"+record.Group+"/"))
+	}
+	sort.Strings(uris)
+	if strings.Join(uris, ",") != "a.json,b.json,uploaded.json" {
+		t.Fatalf("Expected downloaded and uploaded files to be ingested, got %v", uris)
+	}
+	contents, err := submitter.Files.Get(record.Group, "b.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	if b, _ := io.ReadAll(contents); string(b) != `{"b": 2}` {
+		t.Fatalf("Unexpected contents of downloaded file: %q", string(b))
+	}
+
+	for _, bad := range []string{
+		`[{"url": "http://localhost` + strings.TrimPrefix(upstream.URL, "http://127.0.0.1") + `/public/a.json"}]`,
+		`[{"url": "file:///etc/passwd"}]`,
+		`[{"url": "` + upstream.URL + `/redirect", "filename": "c.json"}]`,
+		`[{"url": "` + upstream.URL + `/large.json"}]`,
+		`[{"url": "` + upstream.URL + `/private/export", "filename": "b.json"}]`,
+		`[{"url": "` + upstream.URL + `/public/a.json", "filename": "../escape.json"}]`,
+		`[{"url": "` + upstream.URL + `/public/a.json"}, {"url": "` + upstream.URL + `/public/a.json?copy=1"}]`,
+		`[{"url": "` + upstream.URL + `/public/a.json", "filename": "uploaded.json"}]`,
+		`{"url": "` + upstream.URL + `/public/a.json"}`,
+	} {
+		resp := submit(bad)
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected to be rejected, got %d %s", bad, resp.Code, resp.Body.String())
+		}
+	}
+	if records := submitter.Metadata.List(); len(records) != 1 {
+		t.Fatalf("Expected rejected submissions to be discarded, got %v", records)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const SQLSubmitterEndpoint = "/sql"
+
+// InputSourcePlaceholder is replaced in submitted SQL with a string literal containing the JSON input source for the uploaded files
+const InputSourcePlaceholder = "${inputSource}"
+
+const BadSQLTaskMethodMsg = "/sql endpoint supports POST for submitting SQL-based ingestion tasks"
+
+const BadSQLTaskMsg = "SQL task submissions must be a multi-part upload with the SQL statement as the first part, and all files to ingest as the remaining parts with filenames"
+
+const BadSQLTaskQueryMsg = "SQL statement must be an INSERT or REPLACE statement reading from TABLE(EXTERN(" + InputSourcePlaceholder + ", <inputFormat>, <signature>)), either as plain text, or as a Druid SQL query JSON object"
+
+// SQLTaskRequest is the body of a Druid SQL-based ingestion request
+type SQLTaskRequest struct {
+	Query      string                   `json:"query"`
+	Context    map[string]interface{}   `json:"context,omitempty"`
+	Parameters []map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// SQLStringLiteral quotes a string for use in Druid SQL
+func SQLStringLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func (s *Submitter) SQLTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		ErrorResponse(w, http.StatusMethodNotAllowed, BadSQLTaskMethodMsg)
+		return
+	}
+	multipart, err := r.MultipartReader()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, BadSQLTaskMsg)
+		return
+	}
+	part, err := multipart.NextPart()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, BadSQLTaskMsg)
+		return
+	}
+	taskRequest, ok := parseSQLTaskRequest(w, part, part.Header.Get("Content-Type"))
+	if !ok {
+		return
+	}
+
+	policyRequest, err := SQLPolicyRequest(taskRequest.Query)
+	if err != nil && s.Policy != nil {
+		ErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if !s.checkPolicy(w, r, policyRequest) {
+		return
+	}
+	group, err := s.createGroup(r, policyRequest.DataSource)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	var successful bool
+	defer func() {
+		if !successful {
+			s.discardGroup(group)
+		}
+	}()
+	items, ok := s.receiveFiles(w, r, multipart, group)
+	if !ok {
+		return
+	}
+	successful = s.submitSQLTask(w, r, taskRequest, group, items)
+}
+
+// parseSQLTaskRequest reads an SQL statement, either bare, or as a full query object so that a query context can be provided.
+// If it is invalid, an error response has already been sent.
+func parseSQLTaskRequest(w http.ResponseWriter, r io.Reader, contentType string) (SQLTaskRequest, bool) {
+	taskRequest := SQLTaskRequest{}
+	var err error
+	if strings.HasPrefix(contentType, "application/json") {
+		err = json.NewDecoder(r).Decode(&taskRequest)
+	} else {
+		var query []byte
+		query, err = io.ReadAll(r)
+		taskRequest.Query = string(query)
+	}
+	if err != nil || !strings.Contains(taskRequest.Query, InputSourcePlaceholder) {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusBadRequest, BadSQLTaskQueryMsg)
+		return taskRequest, false
+	}
+	return taskRequest, true
+}
+
+// submitSQLTask points an SQL statement at the files in a group and submits it, and returns true if Druid accepted it
+func (s *Submitter) submitSQLTask(w http.ResponseWriter, r *http.Request, taskRequest SQLTaskRequest, group string, items []string) bool {
+	inputSource, err := s.InputSource.InputSource(group, items)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	inputSourceBytes, err := json.Marshal(inputSource)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	redactedInputSourceBytes, err := json.Marshal(redactedInputSource(inputSource))
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	redactedRequest := taskRequest
+	taskRequest.Query = strings.ReplaceAll(taskRequest.Query, InputSourcePlaceholder, SQLStringLiteral(string(inputSourceBytes)))
+	redactedRequest.Query = strings.ReplaceAll(redactedRequest.Query, InputSourcePlaceholder, SQLStringLiteral(string(redactedInputSourceBytes)))
+
+	taskRequestBytes, err := json.Marshal(taskRequest)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	redactedRequestBytes, err := json.Marshal(redactedRequest)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	fmt.Println(string(redactedRequestBytes))
+	taskResponse, err := s.Druid.SubmitSQLTask(taskRequestBytes, r)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return false
+	}
+	return s.forwardTaskResponse(w, r, group, redactedRequestBytes, taskResponse)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSQLQuery = `INSERT INTO test
+SELECT TIME_PARSE("timestamp") AS __time, page
+FROM TABLE(EXTERN(${inputSource}, '{"type": "json"}', '[{"name": "timestamp", "type": "string"}, {"name": "page", "type": "string"}]'))
+PARTITIONED BY DAY`
+
+func TestSQLTask(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	queryPart, _ := writer.CreateFormField("query.sql")
+	queryPart.Write([]byte(testSQLQuery))
+	filePart, _ := writer.CreateFormFile("file", "it's.json")
+	filePart.Write([]byte(`{"timestamp": "2022-01-01", "page": "a"}`))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/tasks/sql", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	taskResponse := map[string]string{}
+	json.Unmarshal(resp.Body.Bytes(), &taskResponse)
+	if taskResponse["taskId"] != "query-a" {
+		t.Fatalf("Expected MSQ task ID in response, got %s", resp.Body.String())
+	}
+
+	if len(overlord.queries) != 1 {
+		t.Fatalf("Expected one SQL task, got %v", overlord.queries)
+	}
+	query := overlord.queries[0].Query
+	if strings.Contains(query, InputSourcePlaceholder) {
+		t.Fatalf("Placeholder was not substituted: %s", query)
+	}
+	// The input source is embedded as a string literal, with quotes in file names escaped
+	start := strings.Index(query, "EXTERN('") + len("EXTERN('")
+	end := strings.Index(query, "}', '") + 1
+	inputSource := map[string]interface{}{}
+	err := json.Unmarshal([]byte(strings.ReplaceAll(query[start:end], "''", "'")), &inputSource)
+	if err != nil {
+		t.Fatalf("Input source is not a valid JSON string literal: %s: %v", query, err)
+	}
+	if inputSource["type"] != "http" || len(inputSource["uris"].([]interface{})) != 1 {
+		t.Fatalf("Unexpected input source %v", inputSource)
+	}
+	if _, ok := submitter.Metadata.FindTask("query-a"); !ok {
+		t.Fatalf("MSQ task was not tracked")
+	}
+}
+
+func TestSQLTaskRequiresPlaceholder(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	queryPart, _ := writer.CreateFormField("query.sql")
+	queryPart.Write([]byte("SELECT 1"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/tasks/sql", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d %s", resp.Code, resp.Body.String())
+	}
+	if len(overlord.queries) != 0 {
+		t.Fatalf("Invalid query was submitted")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// File is an open submitted file
+type File interface {
+	io.ReadSeekCloser
+	Stat() (os.FileInfo, error)
+}
+
+// FileManager stores groups of submitted files until they are no longer needed by Druid
+type FileManager interface {
+	Init() error
+	Put(group, item string, contents io.Reader) error
+	// Get opens a file. If the file does not exist, the error satisfies os.IsNotExist
+	Get(group, item string) (File, error)
+	Stat(group, item string) (os.FileInfo, error)
+	Delete(group string) error
+	ListGroups() (map[string]os.FileInfo, error)
+}
+
+// ErrOffsetMismatch is returned when appending to a file at an offset other than its current size
+var ErrOffsetMismatch = fmt.Errorf("Offset does not match the current size of the file")
+
+// ErrAppendInProgress is returned when appending to a file which is already being appended to
+var ErrAppendInProgress = fmt.Errorf("File is already being appended to")
+
+// Appender is implemented by FileManagers which can add to the end of files, for resumable uploads
+type Appender interface {
+	// Append writes contents to the end of a file, creating it if it does not exist, if it is currently offset bytes long,
+	// and returns its new size. If reading contents fails part way through, what was read is kept, so that it can be resumed.
+	Append(group, item string, offset int64, contents io.Reader) (int64, error)
+}
+
+// LocalFileManager stores each group as a directory under RootDir
+type LocalFileManager struct {
+	RootDir string
+
+	appendLock sync.Mutex
+	appending  map[string]bool
+}
+
+func (f *LocalFileManager) Init() error {
+	return os.MkdirAll(f.RootDir, 0700)
+}
+
+func (fm *LocalFileManager) Put(group, itemName string, itemContents io.Reader) error {
+	itemPath := path.Join(fm.RootDir, group, itemName)
+	err := os.MkdirAll(path.Dir(itemPath), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(itemPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, itemContents)
+	return err
+}
+
+func (fm *LocalFileManager) Append(group, itemName string, offset int64, itemContents io.Reader) (int64, error) {
+	itemPath := path.Join(fm.RootDir, group, itemName)
+	// Only one append at a time, so that the offset cannot change between checking it and writing
+	fm.appendLock.Lock()
+	if fm.appending[itemPath] {
+		fm.appendLock.Unlock()
+		return 0, ErrAppendInProgress
+	}
+	if fm.appending == nil {
+		fm.appending = map[string]bool{}
+	}
+	fm.appending[itemPath] = true
+	fm.appendLock.Unlock()
+	defer func() {
+		fm.appendLock.Lock()
+		delete(fm.appending, itemPath)
+		fm.appendLock.Unlock()
+	}()
+
+	err := os.MkdirAll(path.Dir(itemPath), 0700)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(itemPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), ErrOffsetMismatch
+	}
+	written, err := io.Copy(f, itemContents)
+	return offset + written, err
+}
+
+func (f *LocalFileManager) Get(group, item string) (File, error) {
+	return os.Open(path.Join(f.RootDir, group, item))
+}
+
+func (f *LocalFileManager) Stat(group, item string) (os.FileInfo, error) {
+	return os.Stat(path.Join(f.RootDir, group, item))
+}
+
+func (f *LocalFileManager) Delete(group string) error {
+	return os.RemoveAll(path.Join(f.RootDir, group))
+}
+
+func (f *LocalFileManager) ListGroups() (map[string]os.FileInfo, error) {
+	dir, err := os.Open(f.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	entries, err := dir.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]os.FileInfo{}
+	for _, entry := range entries {
+		// Hidden entries are gateway state, not groups
+		if HiddenGroup(entry.Name()) {
+			continue
+		}
+		groups[entry.Name()] = entry
+	}
+	return groups, nil
+}
+
+// FileTender deletes groups of files once they pass the retention period,
+// and forgets about them once they pass the history period
+type FileTender struct {
+	Files                FileManager
+	Metadata             *MetadataStore
+	RetentionPeriod      time.Duration
+	HistoryPeriod        time.Duration
+	RetentionCheckPeriod time.Duration
+}
+
+func (f *FileTender) markDeleted(group string, now time.Time) error {
+	err := f.Metadata.Update(group, func(record *GroupRecord) {
+		record.Deleted = now
+	})
+	// Groups from before the metadata store, or whose submission is still in progress, have no record
+	if err == ErrUnknownGroup {
+		return nil
+	}
+	return err
+}
+
+func (f *FileTender) RunRetentionCheck(now time.Time) []error {
+	groups, err := f.Files.ListGroups()
+	if err != nil {
+		return []error{err}
+	}
+	errs := []error{}
+	for group, info := range groups {
+		created := info.ModTime()
+		if record, ok := f.Metadata.Get(group); ok {
+			created = record.LastActive()
+		}
+		if now.Sub(created) <= f.RetentionPeriod {
+			continue
+		}
+		// Mark the group deleted first, so that no more tasks are linked to it while its files are deleted
+		deleting, err := f.Metadata.MarkDeleted(group, now, (*GroupRecord).Expirable)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !deleting {
+			continue
+		}
+		err = f.Files.Delete(group)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Groups whose files are gone, e.g. because the gateway stopped while deleting them
+	for _, record := range f.Metadata.List() {
+		if _, ok := groups[record.Group]; ok || !record.Deleted.IsZero() || now.Sub(record.LastActive()) <= f.RetentionPeriod {
+			continue
+		}
+		err = f.markDeleted(record.Group, now)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err = f.Metadata.Prune(now, f.HistoryPeriod)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (f *FileTender) Run(stop chan struct{}) {
+	ticker := time.NewTicker(f.RetentionCheckPeriod)
+	for {
+		select {
+		case tick := <-ticker.C:
+			f.RunRetentionCheck(tick)
+		case _ = <-stop:
+			return
+		}
+	}
+}
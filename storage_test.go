@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testFileManager checks the behavior all storage backends must share
+func testFileManager(t *testing.T, files FileManager) {
+	err := files.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := map[string]string{
+		"a.json":     `{"a": 1}`,
+		"dir/b.json": `{"b": 2}`,
+		"empty.json": "",
+	}
+	for item, contents := range items {
+		err = files.Put("group-1", item, strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = files.Put("group-2", "c.json", strings.NewReader(`{"c": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for item, expected := range items {
+		contents, err := files.Get("group-1", item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := io.ReadAll(contents)
+		contents.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expected {
+			t.Fatalf("Expected %s to contain %q, got %q", item, expected, string(actual))
+		}
+		info, err := files.Stat("group-1", item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(expected)) {
+			t.Fatalf("Expected %s to be %d bytes, got %d", item, len(expected), info.Size())
+		}
+	}
+
+	contents, err := files.Get("group-1", "a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = contents.Seek(3, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(contents)
+	contents.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != items["a.json"][3:] {
+		t.Fatalf("Expected %q after seeking, got %q", items["a.json"][3:], string(rest))
+	}
+
+	_, err = files.Get("group-1", "missing.json")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected not-exist error, got %v", err)
+	}
+	_, err = files.Stat("group-1", "missing.json")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected not-exist error, got %v", err)
+	}
+
+	groups, err := files.ListGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups["group-1"] == nil || groups["group-2"] == nil {
+		t.Fatalf("Expected group-1 and group-2, got %v", groups)
+	}
+
+	err = files.Delete("group-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err = files.ListGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups["group-2"] == nil {
+		t.Fatalf("Expected only group-2, got %v", groups)
+	}
+	_, err = files.Get("group-1", "a.json")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected not-exist error after delete, got %v", err)
+	}
+}
+
+func TestLocalFileManager(t *testing.T) {
+	testFileManager(t, &LocalFileManager{RootDir: t.TempDir()})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const BadStreamMsg = "Streaming is not enabled on this gateway"
+
+const BadStreamTaskSpecMsg = "Streamed tasks must be index tasks with .spec.dataSchema.granularitySpec.intervals set and dynamic partitioning, so that Druid reads the file exactly once, followed by exactly one file"
+
+const StreamGoneMsg = "This file was streamed to Druid and has already been read, it cannot be read again. Resubmit the task to retry"
+
+const StreamTimeoutMsg = "Druid did not start reading the file in time, the task was shut down"
+
+const StreamFailedMsg = "Streaming the file to Druid failed, the task was shut down"
+
+// ErrStreamClaimed is returned when a stream has already been read
+var ErrStreamClaimed = fmt.Errorf("Stream has already been read")
+
+// ErrExtraStreamedParts ends a stream when more parts follow the streamed file, which the task would otherwise leave out
+var ErrExtraStreamedParts = fmt.Errorf("Streamed submission has more than one file")
+
+type stream struct {
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+	claimed   chan struct{}
+	isClaimed bool
+}
+
+// StreamBroker hands uploads which are being streamed from the Submitter to the Retriever, so that
+// they are never stored. Each stream can only be read once.
+type StreamBroker struct {
+	// Timeout is how long to wait for Druid to start reading a stream
+	Timeout time.Duration
+
+	lock    sync.Mutex
+	streams map[string]*stream
+}
+
+func streamKey(group, item string) string {
+	return group + "/" + item
+}
+
+func (b *StreamBroker) open(group, item string) *stream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.streams == nil {
+		b.streams = map[string]*stream{}
+	}
+	reader, writer := io.Pipe()
+	s := &stream{reader: reader, writer: writer, claimed: make(chan struct{})}
+	b.streams[streamKey(group, item)] = s
+	return s
+}
+
+// pending returns true if a stream is waiting to be read
+func (b *StreamBroker) pending(group, item string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.streams[streamKey(group, item)]
+	return ok && !s.isClaimed
+}
+
+func (b *StreamBroker) close(group, item string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.streams, streamKey(group, item))
+}
+
+// Claim returns the reader of a stream. ok is false if the file is not being streamed.
+func (b *StreamBroker) Claim(group, item string) (reader *io.PipeReader, ok bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.streams[streamKey(group, item)]
+	if !ok {
+		return nil, false, nil
+	}
+	if s.isClaimed {
+		return nil, true, ErrStreamClaimed
+	}
+	s.isClaimed = true
+	close(s.claimed)
+	return s.reader, true, nil
+}
+
+// streamable returns true if a native task will read its input exactly once, in order
+func streamable(taskSpec map[string]interface{}, spec map[string]interface{}) bool {
+	if taskSpec["type"] != "index" {
+		return false
+	}
+	// Without intervals, the task reads its input once to find them before ingesting it
+	dataSchema, _ := spec["dataSchema"].(map[string]interface{})
+	granularitySpec, _ := dataSchema["granularitySpec"].(map[string]interface{})
+	intervals, _ := granularitySpec["intervals"].([]interface{})
+	if len(intervals) == 0 {
+		return false
+	}
+	// Other partitioning schemes read the input once to determine partitions
+	tuningConfig, _ := spec["tuningConfig"].(map[string]interface{})
+	partitionsSpec, _ := tuningConfig["partitionsSpec"].(map[string]interface{})
+	partitionsType, _ := partitionsSpec["type"].(string)
+	return partitionsType == "" || partitionsType == "dynamic"
+}
+
+// IndexStream submits a task which reads the single file in the rest of the submission directly from the request, instead of storing it.
+// The response is not sent until Druid has read the whole file, or failed to.
+func (s *Submitter) IndexStream(w http.ResponseWriter, r *http.Request, taskSpec map[string]interface{}, ioConfig map[string]interface{}, parts *multipart.Reader, dataSource string) {
+	part, err := parts.NextPart()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, BadStreamTaskSpecMsg)
+		return
+	}
+	filename, ok := submittedFilename(part.FileName())
+	if ok && len(ArchiveKind(filename, part.Header.Get("Content-Type"))) != 0 {
+		// Archives are expanded into many files, which cannot be streamed
+		ErrorResponse(w, http.StatusBadRequest, BadStreamTaskSpecMsg)
+		return
+	}
+	if !ok {
+		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
+		return
+	}
+	group, err := s.createGroup(r, dataSource)
+	if err == nil {
+		err = s.Metadata.Update(group, func(record *GroupRecord) {
+			record.Streamed = true
+		})
+	}
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	var successful bool
+	defer func() {
+		if !successful {
+			s.discardGroup(group)
+		}
+	}()
+	// The start of the file is read ahead to infer or check its format, and sent to Druid before the rest of it
+	sample, err := io.ReadAll(io.LimitReader(part, sniffSize))
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusBadRequest, BadIndexTaskMsg)
+		return
+	}
+	err = inferInputFormat(taskSpec, ioConfig, group, []string{filename}, func(item string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(sample)), nil
+	})
+	if err != nil {
+		filesCheckFailed(w, err)
+		return
+	}
+	stream := s.Streams.open(group, filename)
+	defer s.Streams.close(group, filename)
+
+	ioConfig["inputSource"], err = s.InputSource.InputSource(group, []string{filename})
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	taskSpecBytes, err := json.Marshal(taskSpec)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	redactedSpecBytes, err := redactedTaskSpec(taskSpec, ioConfig)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	taskResponse, err := s.Druid.SubmitTask(taskSpecBytes, r)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return
+	}
+	if taskResponse.StatusCode != http.StatusOK && taskResponse.StatusCode != http.StatusAccepted {
+		s.forwardTaskResponse(w, r, group, redactedSpecBytes, taskResponse)
+		return
+	}
+	defer taskResponse.Body.Close()
+	taskResponseBody, err := io.ReadAll(taskResponse.Body)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusBadGateway, InternalErrorMsg)
+		return
+	}
+	// Past this point, the task exists, so the group is kept to record it
+	successful = true
+	taskID := s.trackTask(group, taskResponseBody)
+	shutdown := func() {
+		if len(taskID) == 0 {
+			return
+		}
+		shutdownResponse, err := s.Druid.TaskRequest("POST", taskID, "shutdown", "", r)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		shutdownResponse.Body.Close()
+	}
+
+	select {
+	case <-stream.claimed:
+	case <-time.After(s.Streams.Timeout):
+		fmt.Printf("Druid did not start reading %s/%s within %s\n", group, filename, s.Streams.Timeout)
+		shutdown()
+		ErrorResponse(w, http.StatusGatewayTimeout, StreamTimeoutMsg)
+		return
+	case <-r.Context().Done():
+		fmt.Printf("Client gave up on streaming %s/%s\n", group, filename)
+		shutdown()
+		return
+	}
+	contents := newChecksumReader(io.MultiReader(bytes.NewReader(sample), part))
+	_, err = io.Copy(stream.writer, contents)
+	if err == nil {
+		if _, nextErr := parts.NextPart(); nextErr != io.EOF {
+			err = ErrExtraStreamedParts
+		}
+	}
+	// Failing the stream fails Druid's read, so the task cannot succeed with part of the submission
+	stream.writer.CloseWithError(err)
+	if err == ErrExtraStreamedParts {
+		fmt.Printf("Streaming %s/%s failed: %s\n", group, filename, err)
+		shutdown()
+		ErrorResponse(w, http.StatusBadRequest, BadStreamTaskSpecMsg)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Streaming %s/%s failed: %s\n", group, filename, err)
+		shutdown()
+		ErrorResponse(w, http.StatusBadGateway, StreamFailedMsg)
+		return
+	}
+	err = s.Metadata.Update(group, func(record *GroupRecord) {
+		record.Files = append(record.Files, contents.Record(filename))
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+	s.writeTaskResponse(w, r, group, redactedSpecBytes, taskID, taskResponse, taskResponseBody)
+}
+
+// serveStream sends a file which is being streamed from a submission, and returns false if it is not one
+func (rt *Retriever) serveStream(w http.ResponseWriter, r *http.Request, group, item string) bool {
+	if r.Method == "HEAD" && rt.Streams.pending(group, item) {
+		w.Header().Set("Content-Type", ContentType(item))
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	var reader *io.PipeReader
+	var ok bool
+	var err error
+	if r.Method == "GET" {
+		reader, ok, err = rt.Streams.Claim(group, item)
+	}
+	if !ok {
+		// Streamed files are never stored, so once the stream is gone, so is the file
+		if rt.Metadata == nil {
+			return false
+		}
+		if record, found := rt.Metadata.Get(group); !found || !record.Streamed {
+			return false
+		}
+	}
+	if !ok || err != nil {
+		// e.g. Druid is retrying after a failed read
+		ErrorResponse(w, http.StatusGone, StreamGoneMsg)
+		return true
+	}
+	w.Header().Set("Content-Type", ContentType(item))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		// Let the submitter know Druid did not receive the whole file, and make sure Druid knows too,
+		// instead of ending the response normally and leaving it with a truncated file
+		reader.CloseWithError(err)
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
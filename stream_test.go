@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStreamSpec = `{"type": "index", "spec": {"dataSchema": {"dataSource": "test", "granularitySpec": {"intervals": ["2022-01-01/2022-01-02"]}}, "ioConfig": {"type": "index"}}}`
+
+func TestStreaming(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	(&Retriever{ContextPath: "/files", Files: submitter.Files, Metadata: submitter.Metadata, Streams: submitter.Streams}).Handle(mux)
+	submitFiles := func(spec string, files map[string]string) chan *httptest.ResponseRecorder {
+		body, contentType := buildSubmission(t, spec, files)
+		req := httptest.NewRequest("POST", "/tasks/task?stream=true", body)
+		req.Header.Set("Content-Type", contentType)
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, req)
+			done <- resp
+		}()
+		return done
+	}
+	submit := func(spec string) chan *httptest.ResponseRecorder {
+		return submitFiles(spec, map[string]string{"data.json": `{"a": 1}`})
+	}
+	// streamedPath returns the path the file of the nth submitted task is served from, once Druid would have received it
+	streamedPath := func(n int) string {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			overlord.lock.Lock()
+			var inputSource map[string]interface{}
+			if len(overlord.specs) >= n {
+				inputSource = overlord.specs[n-1]["spec"].(map[string]interface{})["ioConfig"].(map[string]interface{})["inputSource"].(map[string]interface{})
+			}
+			overlord.lock.Unlock()
+			if inputSource != nil {
+				uri, err := url.Parse(inputSource["uris"].([]interface{})[0].(string))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return uri.Path
+			}
+		}
+		t.Fatalf("Task %d was never submitted", n)
+		return ""
+	}
+	fetch := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest(method, path, nil))
+		return resp
+	}
+
+	if resp := <-submit(testStreamSpec); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected streaming to be rejected when disabled, got %d %s", resp.Code, resp.Body.String())
+	}
+	submitter.Streams = &StreamBroker{Timeout: 5 * time.Second}
+	mux = http.NewServeMux()
+	submitter.Handle(mux)
+	(&Retriever{ContextPath: "/files", Files: submitter.Files, Metadata: submitter.Metadata, Streams: submitter.Streams}).Handle(mux)
+	if resp := <-submit(testIndexSpec); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected parallel task to be rejected for streaming, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	done := submit(testStreamSpec)
+	filePath := streamedPath(1)
+	if resp := fetch("HEAD", filePath); resp.Code != http.StatusOK {
+		t.Fatalf("Expected pending stream to exist, got %d", resp.Code)
+	}
+	if resp := fetch("GET", filePath); resp.Code != http.StatusOK || resp.Body.String() != `{"a": 1}` {
+		t.Fatalf("Unexpected streamed file: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := <-done; resp.Code != http.StatusOK {
+		t.Fatalf("Streamed submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	// Druid retrying must fail rather than read a different or partial file
+	if resp := fetch("GET", filePath); resp.Code != http.StatusGone {
+		t.Fatalf("Expected stream to only be readable once, got %d %q", resp.Code, resp.Body.String())
+	}
+	record := submitter.Metadata.List()[0]
+	if !record.Streamed || record.TaskID != "task-a" || len(record.Files) != 1 || len(record.Files[0].SHA256) == 0 {
+		t.Fatalf("Unexpected record of streamed group: %#v", record)
+	}
+
+	submitter.Streams.Timeout = 50 * time.Millisecond
+	resp := <-submit(testStreamSpec)
+	if resp.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected stream to time out, got %d %s", resp.Code, resp.Body.String())
+	}
+	overlord.lock.Lock()
+	status := overlord.statuses["task-b"]
+	overlord.lock.Unlock()
+	if status != TaskStatusFailed {
+		t.Fatalf("Expected task of timed out stream to be shut down, got %s", status)
+	}
+	if resp := fetch("GET", streamedPath(2)); resp.Code != http.StatusGone {
+		t.Fatalf("Expected timed out stream to be gone, got %d", resp.Code)
+	}
+
+	// A second file would be left out of the task, so Druid's read is failed instead of finished
+	submitter.Streams.Timeout = 5 * time.Second
+	done = submitFiles(testStreamSpec, map[string]string{"a.json": `{"a": 1}`, "b.json": `{"b": 2}`})
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Fatalf("Expected read of stream with extra files to be aborted, got %v", recovered)
+			}
+		}()
+		fetch("GET", streamedPath(3))
+	}()
+	if resp := <-done; resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected extra files to be rejected, got %d %s", resp.Code, resp.Body.String())
+	}
+	overlord.lock.Lock()
+	status = overlord.statuses["task-c"]
+	overlord.lock.Unlock()
+	if status != TaskStatusFailed {
+		t.Fatalf("Expected task with extra files to be shut down, got %s", status)
+	}
+
+	// The format is inferred from the start of the file, which is still sent
+	inputFormat := overlord.specs[0]["spec"].(map[string]interface{})["ioConfig"].(map[string]interface{})["inputFormat"]
+	if !reflect.DeepEqual(inputFormat, map[string]interface{}{"type": "json"}) {
+		t.Fatalf("Expected streamed task to have an inferred inputFormat, got %v", inputFormat)
+	}
+	if resp := <-submitFiles(testStreamSpec, map[string]string{"data.bin": "\x00\x01\x02\x03"}); resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "inputFormat") {
+		t.Fatalf("Expected file of unknown format to be rejected, got %d %s", resp.Code, resp.Body.String())
+	}
+	if len(overlord.specs) != 3 {
+		t.Fatalf("Expected file of unknown format not to be submitted, got %d tasks", len(overlord.specs))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TaskStatusUnknown is recorded for tasks which Druid stopped reporting on before they were seen to finish
+const TaskStatusUnknown = "UNKNOWN"
+
+// TaskTracker polls Druid for the status of each submitted task, and cleans up its group of files
+// once Druid reports the task succeeded. Groups whose task failed, or which other tasks were linked to, are left for the FileTender.
+// Tasks are read from the metadata store so that tracking resumes after a restart.
+type TaskTracker struct {
+	Files      FileManager
+	Metadata   *MetadataStore
+	Druid      *DruidClient
+	PollPeriod time.Duration
+}
+
+func (t *TaskTracker) setStatus(group, taskID, status string) error {
+	return t.Metadata.Update(group, func(record *GroupRecord) {
+		record.setTaskStatus(taskID, status)
+	})
+}
+
+func (t *TaskTracker) RunStatusCheck(now time.Time) []error {
+	errs := []error{}
+	for _, record := range t.Metadata.List() {
+		finished := false
+		for _, task := range record.Tasks() {
+			if !task.Pending() {
+				continue
+			}
+			status, err := t.Druid.TaskStatus(task.TaskID)
+			if err == ErrTaskNotFound {
+				// Nothing more to learn about this task, leave its files for the retention check
+				status = TaskStatusUnknown
+			} else if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if status == task.TaskStatus {
+				continue
+			}
+			err = t.setStatus(record.Group, task.TaskID, status)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if TaskStatusFinished(status) {
+				fmt.Printf("Task %s for group %s finished with status %s\n", task.TaskID, record.Group, status)
+				finished = true
+			}
+		}
+		if !finished {
+			continue
+		}
+		// The group is marked deleted first, so that no more tasks are linked to it while its files are deleted.
+		// If deleting them fails, the retention check tries again.
+		deleting, err := t.Metadata.MarkDeleted(record.Group, now, (*GroupRecord).Succeeded)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !deleting {
+			continue
+		}
+		fmt.Printf("The task for group %s succeeded, deleting it\n", record.Group)
+		err = t.Files.Delete(record.Group)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (t *TaskTracker) Run(stop chan struct{}) {
+	ticker := time.NewTicker(t.PollPeriod)
+	for {
+		select {
+		case tick := <-ticker.C:
+			for _, err := range t.RunStatusCheck(tick) {
+				fmt.Println(err)
+			}
+		case _ = <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testIndexSpec = `{"type": "index_parallel", "spec": {"dataSchema": {"dataSource": "test"}, "ioConfig": {"type": "index_parallel"}}}`
+
+// buildSubmission builds a multipart body for the task submission endpoint
+func buildSubmission(t *testing.T, spec string, files map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	specPart, err := writer.CreateFormField("spec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specPart.Write([]byte(spec))
+	for name, contents := range files {
+		filePart, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filePart.Write([]byte(contents))
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+// fakeOverlord is a stand-in for the Druid task API which accepts every task
+type fakeOverlord struct {
+	lock     sync.Mutex
+	statuses map[string]string
+	specs    []map[string]interface{}
+	queries  []SQLTaskRequest
+	// authorizations are the Authorization headers of each request
+	authorizations []string
+}
+
+func (o *fakeOverlord) setStatus(taskID, status string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.statuses[taskID] = status
+}
+
+func (o *fakeOverlord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.authorizations = append(o.authorizations, r.Header.Get("Authorization"))
+	if r.Method == "POST" && r.URL.Path == "/druid/indexer/v1/task" {
+		spec := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&spec)
+		o.specs = append(o.specs, spec)
+		taskID := "task-" + string(rune('a'+len(o.specs)-1))
+		o.statuses[taskID] = TaskStatusRunning
+		json.NewEncoder(w).Encode(map[string]string{"task": taskID})
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/druid/v2/sql/task" {
+		query := SQLTaskRequest{}
+		json.NewDecoder(r.Body).Decode(&query)
+		o.queries = append(o.queries, query)
+		taskID := "query-" + string(rune('a'+len(o.queries)-1))
+		o.statuses[taskID] = TaskStatusRunning
+		json.NewEncoder(w).Encode(map[string]string{"taskId": taskID, "state": TaskStatusRunning})
+		return
+	}
+	taskID, resource := path.Split(strings.TrimPrefix(r.URL.Path, "/druid/indexer/v1/task/"))
+	taskID = strings.TrimSuffix(taskID, "/")
+	status, ok := o.statuses[taskID]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"task": taskID})
+		return
+	}
+	switch resource {
+	case "status":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"task":   taskID,
+			"status": map[string]string{"id": taskID, "statusCode": status, "status": status},
+		})
+	case "reports":
+		json.NewEncoder(w).Encode(map[string]interface{}{"ingestionStatsAndErrors": map[string]string{"taskId": taskID}})
+	case "log":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("log for " + taskID + " from offset " + r.URL.Query().Get("offset")))
+	case "shutdown":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		o.statuses[taskID] = TaskStatusFailed
+		json.NewEncoder(w).Encode(map[string]string{"task": taskID})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestGateway(t *testing.T) (*Submitter, *fakeOverlord) {
+	overlord := &fakeOverlord{statuses: map[string]string{}}
+	overlordServer := httptest.NewServer(overlord)
+	t.Cleanup(overlordServer.Close)
+	indexerURL, err := url.Parse(overlordServer.URL + "/druid/indexer/v1/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlTaskURL, err := url.Parse(overlordServer.URL + "/druid/v2/sql/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDir := t.TempDir()
+	files := &LocalFileManager{RootDir: rootDir}
+	druid := &DruidClient{IndexerEndpoint: *indexerURL, SQLTaskEndpoint: *sqlTaskURL}
+	metadata := &MetadataStore{Path: path.Join(rootDir, ".metadata.json")}
+	err = metadata.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchURL, _ := url.Parse("http://gateway/files/file/")
+	return &Submitter{
+		ContextPath: "/tasks",
+		Files:       files,
+		Druid:       druid,
+		Metadata:    metadata,
+		InputSource: &HTTPInputSource{FetchURLBase: *fetchURL},
+	}, overlord
+}
+
+func TestTaskTrackerCleansUpFinishedTasks(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	groups, err := submitter.Files.ListGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("Expected one group, got %v", groups)
+	}
+
+	// Tracking must survive a restart
+	restarted := &MetadataStore{Path: submitter.Metadata.Path}
+	err = restarted.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &TaskTracker{Files: submitter.Files, Metadata: restarted, Druid: submitter.Druid}
+	record, ok := restarted.FindTask("task-a")
+	if !ok || !record.TaskPending() {
+		t.Fatalf("Expected a pending task after restart, got %v", restarted.List())
+	}
+
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	groups, _ = submitter.Files.ListGroups()
+	if len(groups) != 1 {
+		t.Fatalf("Group deleted while task still running")
+	}
+
+	overlord.setStatus("task-a", TaskStatusSuccess)
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	groups, _ = submitter.Files.ListGroups()
+	if len(groups) != 0 {
+		t.Fatalf("Group not deleted after task finished: %v", groups)
+	}
+	record, ok = restarted.FindTask("task-a")
+	if !ok || record.TaskStatus != TaskStatusSuccess || record.Deleted.IsZero() {
+		t.Fatalf("Finished task not remembered: %v", record)
+	}
+}
+
+func TestTaskTrackerUnknownTask(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	// e.g. the Overlord's metadata was cleaned up
+	delete(overlord.statuses, "task-a")
+	tracker := &TaskTracker{Files: submitter.Files, Metadata: submitter.Metadata, Druid: submitter.Druid}
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	record, _ := submitter.Metadata.FindTask("task-a")
+	if record.TaskStatus != TaskStatusUnknown || record.TaskPending() {
+		t.Fatalf("Expected task status to become unknown, got %v", record)
+	}
+	groups, _ := submitter.Files.ListGroups()
+	if len(groups) != 1 {
+		t.Fatalf("Files for unknown task should be left for the retention check")
+	}
+}
+
+func TestTaskTrackerFailedTask(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	tracker := &TaskTracker{Files: submitter.Files, Metadata: submitter.Metadata, Druid: submitter.Druid}
+	tender := &FileTender{Files: submitter.Files, Metadata: submitter.Metadata, RetentionPeriod: time.Hour, HistoryPeriod: time.Hour}
+	overlord.setStatus("task-a", TaskStatusFailed)
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if groups, _ := submitter.Files.ListGroups(); len(groups) != 1 {
+		t.Fatalf("Files of failed task should be kept until the retention period, so it can be re-run")
+	}
+	if errs := tender.RunRetentionCheck(time.Now().Add(2 * time.Hour)); errs != nil {
+		t.Fatal(errs)
+	}
+	if groups, _ := submitter.Files.ListGroups(); len(groups) != 0 {
+		t.Fatalf("Files of failed task not deleted after the retention period: %v", groups)
+	}
+}
+
+func TestTaskTrackerLinkedTasks(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	request := func(method, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	tracker := &TaskTracker{Files: submitter.Files, Metadata: submitter.Metadata, Druid: submitter.Druid}
+	tender := &FileTender{Files: submitter.Files, Metadata: submitter.Metadata, RetentionPeriod: time.Hour, HistoryPeriod: time.Hour}
+	groupExists := func(group string) bool {
+		groups, _ := submitter.Files.ListGroups()
+		_, ok := groups[group]
+		return ok
+	}
+
+	resp := submitTestTask(t, submitter, map[string]string{"data.json": `{"a": 1}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	group := submitter.Metadata.List()[0].Group
+	if resp := request("POST", "/tasks/groups/"+group+"/submit", testIndexSpec); resp.Code != http.StatusOK {
+		t.Fatalf("Linking task failed: %d %s", resp.Code, resp.Body.String())
+	}
+	overlord.lock.Lock()
+	linkedSpec, _ := json.Marshal(overlord.specs[1])
+	overlord.lock.Unlock()
+	if !strings.Contains(string(linkedSpec), group+"/data.json") {
+		t.Fatalf("Expected linked task to ingest the group's files, got %s", linkedSpec)
+	}
+	if record, ok := submitter.Metadata.FindTask("task-b"); !ok || record.Group != group {
+		t.Fatalf("Linked task not found")
+	}
+
+	overlord.setStatus("task-a", TaskStatusSuccess)
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(group) {
+		t.Fatalf("Group deleted while linked task still running")
+	}
+	// Nor is it deleted past the retention period, without keep=true
+	if errs := tender.RunRetentionCheck(time.Now().Add(2 * time.Hour)); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(group) {
+		t.Fatalf("Group expired while linked task still running")
+	}
+	// Failed tasks can be re-run against the same files, until the retention period has passed
+	overlord.setStatus("task-b", TaskStatusFailed)
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(group) {
+		t.Fatalf("Group deleted once a linked task failed")
+	}
+	if resp := request("POST", "/tasks/groups/"+group+"/submit", testIndexSpec); resp.Code != http.StatusOK {
+		t.Fatalf("Re-running failed task failed: %d %s", resp.Code, resp.Body.String())
+	}
+	overlord.setStatus("task-c", TaskStatusSuccess)
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(group) {
+		t.Fatalf("Group with linked tasks deleted before the retention period")
+	}
+	if errs := tender.RunRetentionCheck(time.Now().Add(2 * time.Hour)); errs != nil {
+		t.Fatal(errs)
+	}
+	if groupExists(group) {
+		t.Fatalf("Group not deleted after every task finished and the retention period passed")
+	}
+	if resp := request("POST", "/tasks/groups/"+group+"/submit", testIndexSpec); resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected deleted group to not be linkable, got %d", resp.Code)
+	}
+
+	// Kept groups outlive even a successful task, so that more tasks can be run against them
+	body, contentType := buildSubmission(t, testIndexSpec, map[string]string{"data.json": `{"a": 1}`})
+	req := httptest.NewRequest("POST", "/tasks/task?keep=true", body)
+	req.Header.Set("Content-Type", contentType)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	record, _ := submitter.Metadata.FindTask("task-d")
+	group = record.Group
+	overlord.setStatus("task-d", TaskStatusSuccess)
+	if errs := tracker.RunStatusCheck(time.Now()); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(group) {
+		t.Fatalf("Kept group deleted once its task succeeded")
+	}
+	if resp := request("POST", "/tasks/groups/"+group+"/submit", testIndexSpec); resp.Code != http.StatusOK {
+		t.Fatalf("Re-running task failed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	// Past the retention period, kept groups are still only deleted once their tasks have finished
+	now := time.Now().Add(2 * time.Hour)
+	if errs := tender.RunRetentionCheck(now); errs != nil {
+		t.Fatal(errs)
+	}
+	if !groupExists(group) {
+		t.Fatalf("Kept group deleted while linked task still running")
+	}
+	overlord.setStatus("task-e", TaskStatusSuccess)
+	if errs := tracker.RunStatusCheck(now); errs != nil {
+		t.Fatal(errs)
+	}
+	if errs := tender.RunRetentionCheck(now); errs != nil {
+		t.Fatal(errs)
+	}
+	if groupExists(group) {
+		t.Fatalf("Kept group not deleted after retention period")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const TemplatesEndpoint = "/templates"
+
+const BadTemplatesMethodMsg = "/templates endpoint supports GET for listing spec templates, and /templates/{name} supports GET for a template, and PUT and DELETE for managing it"
+
+const TemplatesDisabledMsg = "Spec templates are not enabled on this gateway"
+
+const UnknownTemplateMsg = "Unknown spec template"
+
+const NotTemplateAdminMsg = "Only admins may manage spec templates"
+
+// templatePlaceholder matches the ${parameter} placeholders in a spec template
+var templatePlaceholder = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+var templateName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// reservedTemplateParameters are query parameters of submissions which cannot also be template parameters
+var reservedTemplateParameters = []string{"template", "stream", "keep", "envelope", "inferSchema", "dryRun"}
+
+// TemplateParameter is a value callers fill in a spec template with
+type TemplateParameter struct {
+	// Type is string, integer, number, or boolean. Defaults to string.
+	Type        string `json:"type,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Default is used if the parameter is not given. Parameters without a default are required.
+	Default interface{} `json:"default,omitempty"`
+	// Values, if set, are the only values allowed
+	Values []interface{} `json:"values,omitempty"`
+}
+
+// parse converts a parameter given as a string to the parameter's type
+func (p *TemplateParameter) parse(value string) (interface{}, error) {
+	var parsed interface{}
+	var err error
+	switch p.Type {
+	case "", "string":
+		parsed = value
+	case "integer":
+		parsed, err = strconv.ParseInt(value, 10, 64)
+	case "number":
+		parsed, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		parsed, err = strconv.ParseBool(value)
+	default:
+		return nil, fmt.Errorf("Unknown parameter type %s", p.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("must be %s", p.typeName())
+	}
+	return parsed, nil
+}
+
+func (p *TemplateParameter) typeName() string {
+	switch p.Type {
+	case "integer":
+		return "an integer"
+	case "number":
+		return "a number"
+	case "boolean":
+		return "true or false"
+	}
+	return "a string"
+}
+
+// SpecTemplate is a native task spec with ${parameter} placeholders, which is filled in with the parameters of a submission.
+// A placeholder which is a whole JSON string is replaced with the value of the parameter, so that numbers and booleans keep their type.
+type SpecTemplate struct {
+	Description string                        `json:"description,omitempty"`
+	Parameters  map[string]*TemplateParameter `json:"parameters"`
+	Spec        map[string]interface{}        `json:"spec"`
+}
+
+// ParseSpecTemplate reads a spec template, and checks that its parameters and placeholders are valid
+func ParseSpecTemplate(r io.Reader) (*SpecTemplate, error) {
+	template := &SpecTemplate{}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	// Keep numbers as they were written, so that large integers are not formatted in scientific notation
+	decoder.UseNumber()
+	err := decoder.Decode(template)
+	if err != nil {
+		return nil, err
+	}
+	if template.Parameters == nil {
+		template.Parameters = map[string]*TemplateParameter{}
+	}
+	spec, ok := template.Spec["spec"].(map[string]interface{})
+	if !ok || (template.Spec["type"] != "index" && template.Spec["type"] != "index_parallel") {
+		return nil, fmt.Errorf("Template spec must be an index or index_parallel type task")
+	}
+	if _, ok := spec["ioConfig"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("Template spec must have a .spec.ioConfig")
+	}
+	for name, param := range template.Parameters {
+		if placeholder := "${" + name + "}"; templatePlaceholder.FindString(placeholder) != placeholder {
+			return nil, fmt.Errorf("Bad parameter name %q, must be letters, digits, and underscores", name)
+		}
+		for _, reserved := range reservedTemplateParameters {
+			if name == reserved {
+				return nil, fmt.Errorf("%s cannot be used as a parameter name", name)
+			}
+		}
+		if param == nil {
+			param = &TemplateParameter{}
+			template.Parameters[name] = param
+		}
+		switch param.Type {
+		case "", "string", "integer", "number", "boolean":
+		default:
+			return nil, fmt.Errorf("Parameter %s has unknown type %s, must be string, integer, number, or boolean", name, param.Type)
+		}
+		// Defaults and allowed values are checked, and converted to the parameter's type, the same way as given values
+		if param.Default != nil {
+			param.Default, err = param.parse(fmt.Sprint(param.Default))
+			if err != nil {
+				return nil, fmt.Errorf("Default of parameter %s %s", name, err)
+			}
+		}
+		for i, value := range param.Values {
+			param.Values[i], err = param.parse(fmt.Sprint(value))
+			if err != nil {
+				return nil, fmt.Errorf("Allowed values of parameter %s %s", name, err)
+			}
+		}
+	}
+	var undeclared []string
+	walkTemplate(template.Spec, func(s string) {
+		for _, match := range templatePlaceholder.FindAllStringSubmatch(s, -1) {
+			if _, ok := template.Parameters[match[1]]; !ok {
+				undeclared = append(undeclared, match[1])
+			}
+		}
+	})
+	if len(undeclared) != 0 {
+		return nil, fmt.Errorf("Template spec uses undeclared parameters: %s", strings.Join(undeclared, ", "))
+	}
+	return template, nil
+}
+
+// walkTemplate calls visit with every string in a spec
+func walkTemplate(value interface{}, visit func(string)) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, elem := range v {
+			walkTemplate(elem, visit)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			walkTemplate(elem, visit)
+		}
+	case string:
+		visit(v)
+	}
+}
+
+// fillTemplate returns a copy of a spec with its placeholders replaced by values
+func fillTemplate(value interface{}, values map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		filled := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			filled[key] = fillTemplate(elem, values)
+		}
+		return filled
+	case []interface{}:
+		filled := make([]interface{}, len(v))
+		for i, elem := range v {
+			filled[i] = fillTemplate(elem, values)
+		}
+		return filled
+	case string:
+		if match := templatePlaceholder.FindStringSubmatch(v); match != nil && match[0] == v {
+			return values[match[1]]
+		}
+		return templatePlaceholder.ReplaceAllStringFunc(v, func(placeholder string) string {
+			return fmt.Sprint(values[placeholder[2:len(placeholder)-1]])
+		})
+	}
+	return value
+}
+
+// Fill fills in a template with the parameters of a submission, and returns the task spec.
+// Query parameters which are not template parameters are ignored.
+func (t *SpecTemplate) Fill(query url.Values) (map[string]interface{}, error) {
+	names := make([]string, 0, len(t.Parameters))
+	for name := range t.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := map[string]interface{}{}
+	for _, name := range names {
+		param := t.Parameters[name]
+		given, ok := query[name]
+		if !ok || len(given) == 0 {
+			if param.Default == nil {
+				return nil, fmt.Errorf("Parameter %s is required", name)
+			}
+			values[name] = param.Default
+			continue
+		}
+		value, err := param.parse(given[0])
+		if err != nil {
+			return nil, fmt.Errorf("Parameter %s %s", name, err)
+		}
+		if len(param.Values) != 0 {
+			allowed := false
+			for _, allowedValue := range param.Values {
+				allowed = allowed || allowedValue == value
+			}
+			if !allowed {
+				return nil, fmt.Errorf("Parameter %s must be one of %v", name, param.Values)
+			}
+		}
+		values[name] = value
+	}
+	return fillTemplate(t.Spec, values).(map[string]interface{}), nil
+}
+
+// TemplateStore holds the spec templates tasks may be submitted with, each saved in a directory as {name}.json
+type TemplateStore struct {
+	Dir string
+
+	lock      sync.Mutex
+	templates map[string]*SpecTemplate
+}
+
+// LoadTemplates reads every template in a directory, creating it if it does not exist
+func LoadTemplates(dir string) (*TemplateStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	store := &TemplateStore{Dir: dir, templates: map[string]*SpecTemplate{}}
+	for _, templatePath := range paths {
+		name := strings.TrimSuffix(filepath.Base(templatePath), ".json")
+		if !templateName.MatchString(name) {
+			continue
+		}
+		f, err := os.Open(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		template, err := ParseSpecTemplate(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", templatePath, err)
+		}
+		store.templates[name] = template
+	}
+	return store, nil
+}
+
+func (t *TemplateStore) Get(name string) (*SpecTemplate, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	template, ok := t.templates[name]
+	return template, ok
+}
+
+// List returns every template by name
+func (t *TemplateStore) List() map[string]*SpecTemplate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	templates := make(map[string]*SpecTemplate, len(t.templates))
+	for name, template := range t.templates {
+		templates[name] = template
+	}
+	return templates
+}
+
+// Put saves a template, replacing any with the same name
+func (t *TemplateStore) Put(name string, template *SpecTemplate) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	templateBytes, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename so that a crash never leaves a half-written template
+	templatePath := filepath.Join(t.Dir, name+".json")
+	err = os.WriteFile(templatePath+".tmp", templateBytes, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(templatePath+".tmp", templatePath)
+	if err != nil {
+		return err
+	}
+	t.templates[name] = template
+	return nil
+}
+
+// Delete removes a template, and returns false if there was none with its name
+func (t *TemplateStore) Delete(name string) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.templates[name]; !ok {
+		return false, nil
+	}
+	err := os.Remove(filepath.Join(t.Dir, name+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	delete(t.templates, name)
+	return true, nil
+}
+
+// SpecTemplates lists and manages the spec templates tasks may be submitted with.
+// If authentication is enabled, only admins may change them.
+func (s *Submitter) SpecTemplates(w http.ResponseWriter, r *http.Request) {
+	if s.Templates == nil {
+		ErrorResponse(w, http.StatusNotFound, TemplatesDisabledMsg)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, s.ContextPath+TemplatesEndpoint), "/")
+	if len(name) == 0 {
+		if r.Method != "GET" {
+			ErrorResponse(w, http.StatusMethodNotAllowed, BadTemplatesMethodMsg)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Templates.List())
+		return
+	}
+	if !templateName.MatchString(name) {
+		ErrorResponse(w, http.StatusNotFound, UnknownTemplateMsg)
+		return
+	}
+	if (r.Method == "PUT" || r.Method == "DELETE") && s.Auth != nil && !s.Auth.IsAdmin(principalOf(r)) {
+		ErrorResponse(w, http.StatusForbidden, NotTemplateAdminMsg)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		template, ok := s.Templates.Get(name)
+		if !ok {
+			ErrorResponse(w, http.StatusNotFound, UnknownTemplateMsg)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(template)
+	case "PUT":
+		template, err := ParseSpecTemplate(r.Body)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = s.Templates.Put(name, template)
+		if err != nil {
+			fmt.Println(err)
+			ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+			return
+		}
+		fmt.Printf("Template %s saved by %s (%s)\n", name, r.RemoteAddr, principalOf(r).Name)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		found, err := s.Templates.Delete(name)
+		if err != nil {
+			fmt.Println(err)
+			ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+			return
+		}
+		if !found {
+			ErrorResponse(w, http.StatusNotFound, UnknownTemplateMsg)
+			return
+		}
+		fmt.Printf("Template %s deleted by %s (%s)\n", name, r.RemoteAddr, principalOf(r).Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		ErrorResponse(w, http.StatusMethodNotAllowed, BadTemplatesMethodMsg)
+	}
+}
+
+// templateTaskSpec fills in the template named by the template parameter of a submission with its other parameters,
+// and returns it as if it had been submitted. If this fails, an error response has already been sent.
+func (s *Submitter) templateTaskSpec(w http.ResponseWriter, r *http.Request) (taskSpec, spec, ioConfig map[string]interface{}, ok bool) {
+	if s.Templates == nil {
+		ErrorResponse(w, http.StatusBadRequest, TemplatesDisabledMsg)
+		return nil, nil, nil, false
+	}
+	query := r.URL.Query()
+	template, found := s.Templates.Get(query.Get("template"))
+	if !found {
+		ErrorResponse(w, http.StatusBadRequest, UnknownTemplateMsg)
+		return nil, nil, nil, false
+	}
+	filled, err := template.Fill(query)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return nil, nil, nil, false
+	}
+	filledBytes, err := json.Marshal(filled)
+	if err != nil {
+		fmt.Println(err)
+		ErrorResponse(w, http.StatusInternalServerError, InternalErrorMsg)
+		return nil, nil, nil, false
+	}
+	return parseIndexTaskSpec(w, bytes.NewReader(filledBytes))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTemplate = `{
+	"parameters": {
+		"dataSource": {"type": "string"},
+		"granularity": {"type": "string", "default": "DAY", "values": ["HOUR", "DAY"]},
+		"maxRowsPerSegment": {"type": "integer", "default": 5000000},
+		"rollup": {"type": "boolean", "default": false}
+	},
+	"spec": {
+		"type": "index_parallel",
+		"spec": {
+			"dataSchema": {
+				"dataSource": "${dataSource}",
+				"granularitySpec": {"segmentGranularity": "${granularity}", "rollup": "${rollup}"},
+				"transformSpec": {"filter": {"type": "selector", "dimension": "source", "value": "upload-${dataSource}"}}
+			},
+			"ioConfig": {"type": "index_parallel"},
+			"tuningConfig": {"type": "index_parallel", "partitionsSpec": {"type": "dynamic", "maxRowsPerSegment": "${maxRowsPerSegment}"}}
+		}
+	}
+}`
+
+func TestSpecTemplates(t *testing.T) {
+	submitter, overlord := newTestGateway(t)
+	templatesDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(templatesDir, "wiki.json"), []byte(testTemplate), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitter.Templates, err = LoadTemplates(templatesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	submitter.Handle(mux)
+	request := func(method, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		if len(contentType) != 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	submit := func(query string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		filePart, _ := writer.CreateFormFile("file", "data.json")
+		filePart.Write([]byte(`{"a": 1}`))
+		writer.Close()
+		return request("POST", "/tasks/task?"+query, body, writer.FormDataContentType())
+	}
+
+	resp := submit("template=wiki&dataSource=edits&granularity=HOUR&keep=true")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submission failed: %d %s", resp.Code, resp.Body.String())
+	}
+	overlord.lock.Lock()
+	submitted, _ := json.Marshal(overlord.specs[0])
+	overlord.lock.Unlock()
+	for _, expected := range []string{
+		`"dataSource":"edits"`,
+		`"segmentGranularity":"HOUR"`,
+		`"rollup":false`,
+		`"maxRowsPerSegment":5000000`,
+		`"value":"upload-edits"`,
+		`/data.json"]`,
+	} {
+		if !strings.Contains(string(submitted), expected) {
+			t.Fatalf("Expected %s in submitted spec %s", expected, submitted)
+		}
+	}
+
+	for query, expected := range map[string]string{
+		"template=wiki": "Parameter dataSource is required",
+		"template=wiki&dataSource=edits&granularity=WEEK":   "Parameter granularity must be one of [HOUR DAY]",
+		"template=wiki&dataSource=edits&rollup=maybe":       "Parameter rollup must be true or false",
+		"template=wiki&dataSource=edits&maxRowsPerSegment=": "Parameter maxRowsPerSegment must be an integer",
+		"template=unknown&dataSource=edits":                 UnknownTemplateMsg,
+	} {
+		resp := submit(query)
+		if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), expected) {
+			t.Fatalf("%s: expected %q, got %d %s", query, expected, resp.Code, resp.Body.String())
+		}
+	}
+
+	// Templates can be managed through the gateway, and are saved to the directory
+	resp = request("PUT", "/tasks/templates/minimal", strings.NewReader(`{"parameters": {"dataSource": {}}, "spec": {"type": "index", "spec": {"dataSchema": {"dataSource": "${dataSource}"}, "ioConfig": {"type": "index"}}}}`), "")
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Saving template failed: %d %s", resp.Code, resp.Body.String())
+	}
+	for _, bad := range []string{
+		`{"parameters": {}, "spec": {"type": "index", "spec": {"dataSchema": {"dataSource": "${dataSource}"}, "ioConfig": {}}}}`,
+		`{"parameters": {"n": {"type": "integer", "default": "many"}}, "spec": {"type": "index", "spec": {"ioConfig": {}}}}`,
+		`{"parameters": {"keep": {}}, "spec": {"type": "index", "spec": {"ioConfig": {}}}}`,
+		`{"parameters": {}, "spec": {"type": "kill", "spec": {"ioConfig": {}}}}`,
+	} {
+		if resp := request("PUT", "/tasks/templates/bad", strings.NewReader(bad), ""); resp.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be rejected, got %d", bad, resp.Code)
+		}
+	}
+	reloaded, err := LoadTemplates(templatesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templates := reloaded.List(); len(templates) != 2 || templates["minimal"] == nil {
+		t.Fatalf("Expected saved template to be loaded, got %v", templates)
+	}
+	resp = request("GET", "/tasks/templates", nil, "")
+	listed := map[string]*SpecTemplate{}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil || len(listed) != 2 {
+		t.Fatalf("Unexpected template list %v %v", listed, err)
+	}
+	if resp := request("DELETE", "/tasks/templates/minimal", nil, ""); resp.Code != http.StatusNoContent {
+		t.Fatalf("Deleting template failed: %d", resp.Code)
+	}
+	if resp := request("GET", "/tasks/templates/minimal", nil, ""); resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected deleted template to be gone, got %d", resp.Code)
+	}
+
+	// Groups uploaded separately can be submitted with templates too
+	record, _ := submitter.Metadata.FindTask("task-a")
+	resp = request("POST", "/tasks/groups/"+record.Group+"/submit?template=wiki&dataSource=other", nil, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Submitting group with template failed: %d %s", resp.Code, resp.Body.String())
+	}
+}
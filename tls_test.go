@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate, signed by parent if set, or self-signed otherwise
+func testCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	otherCA := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	client := func(commonName string, dnsNames []string, ca *tls.Certificate) *tls.Certificate {
+		cert := testCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: commonName, Organization: []string{"druid"}},
+			DNSNames:    dnsNames,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		return &cert
+	}
+	caPath := path.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTLSConfig("", "", caPath, nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error verifying clients without TLS")
+	}
+	_, err = ParseTLSConfig("cert.pem", "key.pem", "", []string{"middlemanager"}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error allowing subjects without a client CA")
+	}
+
+	config, err := ParseTLSConfig("cert.pem", "key.pem", caPath, []string{"middlemanager-*"}, []string{"*.workers.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := config.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	cases := []struct {
+		name    string
+		cert    *tls.Certificate
+		allowed bool
+	}{
+		{"no certificate", nil, false},
+		{"allowed subject", client("middlemanager-1", nil, &ca), true},
+		{"allowed SAN", client("worker", []string{"mm-1.workers.example.com"}, &ca), true},
+		{"disallowed certificate", client("someone", []string{"someone.example.com"}, &ca), false},
+		{"untrusted CA", client("middlemanager-1", nil, &otherCA), false},
+	}
+	for _, c := range cases {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = nil
+		if c.cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*c.cert}
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if c.allowed && (err != nil || resp.StatusCode != http.StatusOK) {
+			t.Fatalf("%s: expected to be allowed, got %v", c.name, err)
+		}
+		if !c.allowed && err == nil {
+			t.Fatalf("%s: expected to be rejected", c.name)
+		}
+	}
+}